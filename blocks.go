@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Block Kit rendering. The vendored slack client predates Block Kit, so the
+// block types are defined here and messages with blocks are posted through
+// callWebAPI.
+// See: https://api.slack.com/reference/block-kit/blocks
+
+const (
+	// Slack rejects section text longer than 3000 characters
+	maxSectionText = 3000
+	// and messages with more than 50 blocks
+	maxBlocks = 50
+)
+
+type Block struct {
+	Type      string        `json:"type"`
+	BlockID   string        `json:"block_id,omitempty"`
+	Text      *TextObject   `json:"text,omitempty"`
+	Accessory *Element      `json:"accessory,omitempty"`
+	Elements  []interface{} `json:"elements,omitempty"` // context and actions blocks
+}
+
+type TextObject struct {
+	Type string `json:"type"` // "mrkdwn" or "plain_text"
+	Text string `json:"text"`
+}
+
+// Element is an interactive or image element
+type Element struct {
+	Type     string      `json:"type"`
+	Text     *TextObject `json:"text,omitempty"`
+	ActionID string      `json:"action_id,omitempty"`
+	URL      string      `json:"url,omitempty"`
+	Value    string      `json:"value,omitempty"`
+	Style    string      `json:"style,omitempty"`
+	ImageURL string      `json:"image_url,omitempty"`
+	AltText  string      `json:"alt_text,omitempty"`
+}
+
+func mrkdwn(text string) *TextObject {
+	return &TextObject{Type: "mrkdwn", Text: text}
+}
+
+func plainText(text string) *TextObject {
+	return &TextObject{Type: "plain_text", Text: text}
+}
+
+// Reply is what a command answers with. Text is always set: it's what
+// notifications show, and the whole reply wherever blocks can't be shown.
+type Reply struct {
+	Text   string
+	Blocks []Block
+}
+
+func textReply(text string) Reply {
+	return Reply{Text: text}
+}
+
+// quote formats possibly multi-line text as a mrkdwn block quote
+func quote(text string) string {
+	if strings.TrimSpace(text) == "" {
+		return ""
+	}
+	return "> " + strings.Replace(text, "\n", "\n> ", -1)
+}
+
+// truncate shortens text to at most max characters without splitting a rune
+func truncate(text string, max int) string {
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:max-1]) + "…"
+}
+
+func button(text string, actionID string, value string) Element {
+	return Element{Type: "button", Text: plainText(text), ActionID: actionID, Value: value}
+}
+
+// loreKey identifies a lore in button values and block IDs. Legacy lores
+// without a channel and timestamp have no key and get no buttons.
+func loreKey(lore Lore) string {
+	if lore.ChannelID == "" || lore.MessageTS == "" {
+		return ""
+	}
+	return lore.ChannelID + "/" + lore.MessageTS
+}
+
+// parseLoreKey splits a loreKey back into channel and timestamp
+func parseLoreKey(key string) (string, string, bool) {
+	i := strings.Index(key, "/")
+	if i <= 0 || i == len(key)-1 {
+		return "", "", false
+	}
+	return key[:i], key[i+1:], true
+}
+
+// loreBlockPrefix starts the block ID of every block rendering the lore
+// with key, so a vote can find and re-render them in place
+func loreBlockPrefix(key string) string {
+	return "lore:" + key + ":"
+}
+
+// loreBlocks renders a single lore as a quote with a link back to the
+// original, then a line with who said it, its score and when, then voting
+// buttons.
+func (l *Lorebot) loreBlocks(lore Lore) []Block {
+	section := Block{Type: "section", Text: mrkdwn(truncate(quote(lore.Message), maxSectionText))}
+	if section.Text.Text == "" {
+		section.Text.Text = "_(no text)_"
+	}
+	if lore.Permalink != "" {
+		section.Accessory = &Element{
+			Type:     "button",
+			Text:     plainText("View"),
+			URL:      lore.Permalink,
+			ActionID: "view_lore",
+		}
+	}
+
+	context := make([]interface{}, 0)
+	if avatar := l.avatarURL(lore.userID); avatar != "" {
+		context = append(context, Element{Type: "image", ImageURL: avatar, AltText: "avatar"})
+	}
+	meta := "<@" + lore.userID + "> · :lore: " + strconv.Itoa(lore.Score)
+	if !lore.Added.IsZero() && lore.Added.Unix() > 0 {
+		// Slack shows the date in the reader's timezone
+		fallback := lore.Added.Format("2006-01-02")
+		meta += fmt.Sprintf(" · <!date^%d^{date_short}|%s>", lore.Added.Unix(), fallback)
+	}
+	context = append(context, mrkdwn(meta))
+
+	blocks := []Block{section, {Type: "context", Elements: context}}
+	if attachments := strings.TrimPrefix(formatAttachments(lore.Attachments), "\n"); attachments != "" {
+		blocks = append(blocks, Block{Type: "context", Elements: []interface{}{
+			mrkdwn(truncate(strings.Replace(attachments, "> ", "", -1), maxSectionText)),
+		}})
+	}
+	if key := loreKey(lore); key != "" {
+		blocks = append(blocks, Block{Type: "actions", Elements: []interface{}{
+			button(":lore: Upvote", "upvote_lore", key),
+			button("Remove vote", "retract_vote", key),
+		}})
+		for i := range blocks {
+			blocks[i].BlockID = loreBlockPrefix(key) + strconv.Itoa(i)
+		}
+	}
+	return blocks
+}
+
+// replaceLoreBlocks swaps the blocks rendering the lore with key for
+// replacement, which may be empty to remove it
+func replaceLoreBlocks(blocks []Block, key string, replacement []Block) []Block {
+	ret := make([]Block, 0, len(blocks))
+	replaced := false
+	for _, block := range blocks {
+		if !strings.HasPrefix(block.BlockID, loreBlockPrefix(key)) {
+			ret = append(ret, block)
+			continue
+		}
+		if !replaced {
+			ret = append(ret, replacement...)
+			replaced = true
+		}
+	}
+	return ret
+}
+
+// loresReply renders a list of lores, with footer as a note at the end
+func (l *Lorebot) loresReply(lores []Lore, footer string) Reply {
+	l.prefetchAvatars(lores)
+	reply := Reply{Text: formatLores(lores) + footer}
+	for i, lore := range lores {
+		if i > 0 {
+			reply.Blocks = append(reply.Blocks, Block{Type: "divider"})
+		}
+		reply.Blocks = append(reply.Blocks, l.loreBlocks(lore)...)
+	}
+	if footer != "" {
+		reply.Blocks = append(reply.Blocks, Block{Type: "context", Elements: []interface{}{mrkdwn(footer)}})
+	}
+	if len(reply.Blocks) > maxBlocks {
+		// Better to fall back to text than to have Slack reject the message
+		reply.Blocks = nil
+	}
+	return reply
+}
+
+// withButtons adds a row of buttons to the end of a reply, if it has blocks
+// and room for them
+func (r Reply) withButtons(buttons ...Element) Reply {
+	if len(r.Blocks) == 0 || len(r.Blocks) >= maxBlocks {
+		return r
+	}
+	elements := make([]interface{}, len(buttons))
+	for i, b := range buttons {
+		elements[i] = b
+	}
+	r.Blocks = append(r.Blocks, Block{Type: "actions", BlockID: "listing", Elements: elements})
+	return r
+}
+
+// avatarCache remembers profile pictures so a listing doesn't look the same
+// person up over and over. Failed lookups are remembered too, for a while,
+// so a missing user doesn't cost an API call on every render.
+type avatarCache struct {
+	mu      sync.Mutex
+	urls    map[string]string
+	retryAt map[string]time.Time // when to look up a user that failed again
+}
+
+// How long to wait before retrying a failed avatar lookup
+const avatarRetry = 10 * time.Minute
+
+// prefetchAvatars looks up everyone in lores at once, rather than one at a
+// time as each lore is rendered
+func (l *Lorebot) prefetchAvatars(lores []Lore) {
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+	for _, lore := range lores {
+		if seen[lore.userID] {
+			continue
+		}
+		seen[lore.userID] = true
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			l.avatarURL(userID)
+		}(lore.userID)
+	}
+	wg.Wait()
+}
+
+// avatarURL returns a small profile picture for userID, or "" if it can't
+func (l *Lorebot) avatarURL(userID string) string {
+	if l.SlackAPI == nil || userID == "" {
+		return ""
+	}
+	l.avatars.mu.Lock()
+	avatar, ok := l.avatars.urls[userID]
+	retryAt := l.avatars.retryAt[userID]
+	l.avatars.mu.Unlock()
+	if ok || time.Now().Before(retryAt) {
+		return avatar
+	}
+
+	// Not holding the lock, so other renders aren't stuck behind this call
+	user, err := l.SlackAPI.GetUserInfo(userID)
+
+	l.avatars.mu.Lock()
+	defer l.avatars.mu.Unlock()
+	if err != nil {
+		slackAPIErrors.Inc("users.info")
+		fmt.Printf("failed to get user info: %v\n", err)
+		if l.avatars.retryAt == nil {
+			l.avatars.retryAt = make(map[string]time.Time)
+		}
+		l.avatars.retryAt[userID] = time.Now().Add(avatarRetry)
+		return ""
+	}
+	if l.avatars.urls == nil {
+		l.avatars.urls = make(map[string]string)
+	}
+	l.avatars.urls[userID] = user.Profile.Image48
+	return user.Profile.Image48
+}
+
+// postBlocks posts a message with blocks, which the vendored client can't do
+// See: https://api.slack.com/methods/chat.postMessage
+func (l *Lorebot) postBlocks(msg Message) error {
+	blocks, err := json.Marshal(msg.Blocks)
+	if err != nil {
+		return err
+	}
+	values := url.Values{
+		"channel":    {msg.ChannelID},
+		"text":       {msg.Content},
+		"blocks":     {string(blocks)},
+		"username":   {"Lorebot"},
+		"icon_emoji": {":lore:"},
+	}
+	if msg.ThreadTS != "" {
+		values.Set("thread_ts", msg.ThreadTS)
+	}
+	return callWebAPI(l.Token, "chat.postMessage", values, nil)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Command is something the bot can be asked to do, e.g. `@lorebot top`.
+type Command struct {
+	Name    string
+	Aliases []string
+	Args    string // argument synopsis for the usage line, e.g. "<username>"
+	Help    string // one line description
+	MinArgs int
+	MaxArgs int // -1 for no limit
+	Run     func(l *Lorebot, args []string) Reply
+}
+
+func (c *Command) Usage() string {
+	if c.Args == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Args
+}
+
+// CommandRegistry looks commands up by name or alias and generates help
+// from them, so adding a command is just registering it.
+type CommandRegistry struct {
+	commands []*Command
+	byName   map[string]*Command
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{byName: make(map[string]*Command)}
+}
+
+func (r *CommandRegistry) Register(cmd *Command) {
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if _, ok := r.byName[name]; ok {
+			panic("command registered twice: " + name)
+		}
+		r.byName[name] = cmd
+	}
+	r.commands = append(r.commands, cmd)
+}
+
+func (r *CommandRegistry) Lookup(name string) (*Command, bool) {
+	cmd, ok := r.byName[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// Help lists every command with its usage
+func (r *CommandRegistry) Help() string {
+	sorted := make([]*Command, len(r.commands))
+	copy(sorted, r.commands)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	out := "Usage: @lorebot <command>\n"
+	for _, cmd := range sorted {
+		out += "`" + cmd.Usage() + "` - " + cmd.Help + "\n"
+	}
+	return out
+}
+
+// HelpFor describes a single command
+func (r *CommandRegistry) HelpFor(name string) string {
+	cmd, ok := r.Lookup(name)
+	if !ok {
+		return "Unknown command `" + name + "`. Try `help`."
+	}
+	out := "Usage: `" + cmd.Usage() + "`\n" + cmd.Help + "\n"
+	if len(cmd.Aliases) > 0 {
+		out += "Also known as: " + strings.Join(cmd.Aliases, ", ") + "\n"
+	}
+	return out
+}
+
+// Run dispatches to a command, checking it got the right number of
+// arguments first
+func (r *CommandRegistry) Run(l *Lorebot, name string, args []string) Reply {
+	cmd, ok := r.Lookup(name)
+	if !ok {
+		return textReply("Unknown command `" + name + "`. Try `help`.")
+	}
+	if len(args) < cmd.MinArgs || (cmd.MaxArgs >= 0 && len(args) > cmd.MaxArgs) {
+		return textReply("Usage: `" + cmd.Usage() + "`")
+	}
+	commandsHandled.Inc(cmd.Name)
+	return cmd.Run(l, args)
+}
+
+const (
+	// How many lores a page of `recent` or `top` shows unless asked for more
+	shortListSize = 3
+	// and of `user` or `onthisday`
+	pageSize = 10
+	// The most lores one command can ask for if MaxResults isn't configured
+	defaultMaxResults = 10
+	// How many people a page of highscores shows
+	highscoresPageSize = 20
+	// No listing is anywhere near this many pages long
+	maxPage = 10000
+)
+
+var commands = NewCommandRegistry()
+
+func init() {
+	commands.Register(&Command{
+		Name:    "help",
+		Args:    "[command]",
+		Help:    "list the commands, or explain one",
+		MaxArgs: 1,
+		Run: func(l *Lorebot, args []string) Reply {
+			if len(args) == 1 {
+				return textReply(commands.HelpFor(args[0]))
+			}
+			return textReply(commands.Help())
+		},
+	})
+	commands.Register(&Command{
+		Name:    "random",
+		Args:    "[count]",
+		Help:    "a random lore, or several",
+		MaxArgs: 1,
+		Run: func(l *Lorebot, args []string) Reply {
+			count, ok := l.resultCount(args, 1)
+			if !ok {
+				return textReply("Usage: `random [count]`")
+			}
+			again := "random"
+			if len(args) > 0 {
+				again += " " + strconv.Itoa(count)
+			}
+			return l.listLores(l.Store.RandomLore(count)).withButtons(button("Another random", "run_command", again))
+		},
+	})
+	commands.Register(&Command{
+		Name:    "recent",
+		Aliases: []string{"latest"},
+		Args:    "[count] [page <n>]",
+		Help:    "the newest lore",
+		MaxArgs: 3,
+		Run: func(l *Lorebot, args []string) Reply {
+			return l.countedLores("recent", args, l.Store.RecentLore)
+		},
+	})
+	commands.Register(&Command{
+		Name:    "top",
+		Aliases: []string{"best"},
+		Args:    "[week|month|year|all] [count] [page <n>]",
+		Help:    "the highest scoring lore, or the most voted for lately",
+		MaxArgs: 4,
+		Run: func(l *Lorebot, args []string) Reply {
+			args, window, since := parseWindow(args, time.Now())
+			return l.countedLores(strings.TrimSpace("top "+window), args, func(limit int, offset int) ([]Lore, error) {
+				return l.Store.TopLore(since, limit, offset)
+			})
+		},
+	})
+	commands.Register(&Command{
+		Name:    "user",
+		Args:    "<username> [page <n>]",
+		Help:    "all of someone's lore, newest first",
+		MinArgs: 1,
+		MaxArgs: 3,
+		Run: func(l *Lorebot, args []string) Reply {
+			args, page := parsePage(args)
+			if len(args) != 1 {
+				return textReply("Usage: `user <username> [page <n>]`")
+			}
+			userID := parseUserID(args[0])
+			return l.pagedLores("user "+args[0], page, pageSize, func(limit int, offset int) ([]Lore, error) {
+				return l.Store.LoreForUser(userID, limit, offset)
+			})
+		},
+	})
+	commands.Register(&Command{
+		Name:    "onthisday",
+		Args:    "[page <n>]",
+		Help:    "lore added on today's date in earlier years",
+		MaxArgs: 2,
+		Run: func(l *Lorebot, args []string) Reply {
+			args, page := parsePage(args)
+			if len(args) > 0 {
+				return textReply("Usage: `onthisday [page <n>]`")
+			}
+			day := time.Now()
+			return l.pagedLores("onthisday", page, pageSize, func(limit int, offset int) ([]Lore, error) {
+				return l.Store.LoreOnThisDay(day, limit, offset)
+			})
+		},
+	})
+	commands.Register(&Command{
+		Name:    "search",
+		Aliases: []string{"find"},
+		Args:    "<query> [from:@user] [in:#channel] [after:yyyy-mm-dd] [before:yyyy-mm-dd] [score:>n] [page <n>]",
+		Help:    `search lore text; use "quotes" for phrases and -word to exclude`,
+		MinArgs: 1,
+		MaxArgs: -1,
+		Run:     searchCommand,
+	})
+	commands.Register(&Command{
+		Name:    "highscores",
+		Aliases: []string{"leaderboard"},
+		Args:    "[week|month|year|all] [page <n>]",
+		Help:    "whose lore has the most votes, ever or lately",
+		MaxArgs: 3,
+		Run:     highscoresCommand,
+	})
+}
+
+func highscoresCommand(l *Lorebot, args []string) Reply {
+	args, window, since := parseWindow(args, time.Now())
+	args, page := parsePage(args)
+	if len(args) > 0 {
+		return textReply("Usage: `highscores [week|month|year|all] [page <n>]`")
+	}
+	highscores, err := l.Store.Highscores(since, highscoresPageSize+1, (page-1)*highscoresPageSize)
+	if err != nil {
+		return textReply(friendlyError("failed to get highscores", err))
+	}
+	more := len(highscores) > highscoresPageSize
+	if more {
+		highscores = highscores[:highscoresPageSize]
+	}
+	out := ""
+	for _, highscore := range highscores {
+		out += "<@" + highscore.UserID + ">" + ": " + strconv.Itoa(highscore.Score) + "\n"
+	}
+	if !more {
+		return textReply(out)
+	}
+	next := fmt.Sprintf("%s page %d", strings.TrimSpace("highscores "+window), page+1)
+	out += "More results: `" + next + "`\n"
+	reply := Reply{Text: out, Blocks: []Block{{Type: "section", Text: mrkdwn(out)}}}
+	return reply.withButtons(button("Next page", "run_command", next))
+}
+
+func searchCommand(l *Lorebot, args []string) Reply {
+	args, page := parseSearchPage(args)
+	query := joinArgs(args)
+	filter, err := parseSearchFilter(args)
+	if err == nil {
+		err = l.resolveSearchFilter(&filter)
+	}
+	if err != nil {
+		return textReply("Couldn't search: " + err.Error())
+	}
+
+	return l.pagedLores("search "+query, page, searchPageSize, func(limit int, offset int) ([]Lore, error) {
+		if filter.IsFiltered() {
+			return l.Store.SearchLoreFiltered(filter, limit, offset)
+		}
+		return l.Store.SearchLore(query, limit, offset)
+	})
+}
+
+// pagedLores renders page of a listing, size lores to a page. It fetches
+// one extra lore to find out whether there's a next page, and if so offers
+// a button that runs `<command> page <n>` to show it.
+func (l *Lorebot) pagedLores(command string, page int, size int, fetch func(limit int, offset int) ([]Lore, error)) Reply {
+	lores, err := fetch(size+1, (page-1)*size)
+	if err != nil {
+		return textReply(friendlyError("failed to get lore", err))
+	}
+	if len(lores) == 0 {
+		if page > 1 {
+			return textReply("No more lore.\n")
+		}
+		return textReply("No lore found.\n")
+	}
+	if len(lores) <= size {
+		return l.loresReply(lores, "")
+	}
+	next := fmt.Sprintf("%s page %d", command, page+1)
+	reply := l.loresReply(lores[:size], "More results: `"+next+"`\n")
+	return reply.withButtons(button("Next page", "run_command", next))
+}
+
+// countedLores runs a listing command like `top 10 page 2`, where the
+// count is how many lores to show on each page
+func (l *Lorebot) countedLores(command string, args []string, fetch func(limit int, offset int) ([]Lore, error)) Reply {
+	args, page := parsePage(args)
+	count, ok := l.resultCount(args, shortListSize)
+	if !ok {
+		return textReply("Usage: `" + command + " [count] [page <n>]`")
+	}
+	if len(args) > 0 {
+		command += " " + strconv.Itoa(count)
+	}
+	return l.pagedLores(command, page, count, fetch)
+}
+
+// resultCount reads the optional count argument of a listing, capped at
+// MaxResults. Reports false if the argument isn't a count.
+func (l *Lorebot) resultCount(args []string, def int) (int, bool) {
+	max := l.MaxResults
+	if max <= 0 {
+		max = defaultMaxResults
+	}
+	count := def
+	if len(args) > 1 {
+		return 0, false
+	}
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return 0, false
+		}
+		count = n
+	}
+	if count > max {
+		count = max
+	}
+	return count, true
+}
+
+// parseWindow splits a leading time window like "week" off a command's
+// arguments and works out when it started. The window is "" and since is
+// zero for all time.
+func parseWindow(args []string, now time.Time) ([]string, string, time.Time) {
+	if len(args) == 0 {
+		return args, "", time.Time{}
+	}
+	switch window := strings.ToLower(args[0]); window {
+	case "week":
+		return args[1:], window, now.AddDate(0, 0, -7)
+	case "month":
+		return args[1:], window, now.AddDate(0, -1, 0)
+	case "year":
+		return args[1:], window, now.AddDate(-1, 0, 0)
+	case "all":
+		return args[1:], "", time.Time{}
+	}
+	return args, "", time.Time{}
+}
+
+// parsePage splits a trailing "page N" off a command's arguments. Pages past
+// maxPage are treated as maxPage, which keeps offsets from overflowing.
+func parsePage(args []string) ([]string, int) {
+	if len(args) < 2 || args[len(args)-2] != "page" {
+		return args, 1
+	}
+	page, err := strconv.Atoi(args[len(args)-1])
+	if err != nil || page < 1 {
+		return args, 1
+	}
+	if page > maxPage {
+		page = maxPage
+	}
+	return args[:len(args)-2], page
+}
+
+// listLores renders the result of one of the store's listing queries
+func (l *Lorebot) listLores(lores []Lore, err error) Reply {
+	if err != nil {
+		return textReply(friendlyError("failed to get lore", err))
+	}
+	return l.loresReply(lores, "")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Events API support. Slack POSTs each event to /slack/events instead of
+// pushing it down the RTM websocket.
+// See: https://api.slack.com/apis/connections/events-api
+
+// How long to remember event IDs for spotting Slack's retries. Slack gives
+// up retrying well within this.
+const seenEventTTL = time.Hour
+
+type eventEnvelope struct {
+	Type      string          `json:"type"`
+	Challenge string          `json:"challenge"`
+	EventID   string          `json:"event_id"`
+	Event     json.RawMessage `json:"event"`
+}
+
+type innerEvent struct {
+	Type string `json:"type"`
+}
+
+// seenEvents remembers recently handled event IDs
+type seenEvents struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// markSeen records id and reports whether it had already been seen
+func (s *seenEvents) markSeen(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.seen == nil {
+		s.seen = make(map[string]time.Time)
+	}
+	for seenID, at := range s.seen {
+		if now.Sub(at) > seenEventTTL {
+			delete(s.seen, seenID)
+		}
+	}
+	if _, ok := s.seen[id]; ok {
+		return true
+	}
+	s.seen[id] = now
+	return false
+}
+
+// HandleEvents receives Events API callbacks. Slack expects a reply within
+// three seconds, so events are acknowledged straight away and handled in
+// the background.
+func (l *Lorebot) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	body, err := verifySlackRequest(r, l.SigningSecret)
+	if err != nil {
+		fmt.Printf("rejected event: %v\n", err)
+		http.Error(w, "invalid request", http.StatusUnauthorized)
+		return
+	}
+
+	var envelope eventEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return
+	}
+
+	switch envelope.Type {
+	case "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(envelope.Challenge))
+	case "event_callback":
+		// Slack retries anything we were slow to acknowledge; only the
+		// first delivery gets handled
+		if l.seenEvents.markSeen(envelope.EventID) {
+			fmt.Printf("Ignoring retry %s of event %s\n", r.Header.Get("X-Slack-Retry-Num"), envelope.EventID)
+		} else {
+			go l.dispatchEvent(envelope.Event)
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// dispatchEvent hands an Events API event to the same handlers the RTM
+// connection uses
+func (l *Lorebot) dispatchEvent(raw json.RawMessage) {
+	var inner innerEvent
+	if err := json.Unmarshal(raw, &inner); err != nil {
+		fmt.Printf("failed to decode event: %v\n", err)
+		return
+	}
+
+	var err error
+	switch inner.Type {
+	case "message":
+		var ev slack.MessageEvent
+		if err = json.Unmarshal(raw, &ev); err == nil {
+			l.HandleMessage(&ev)
+		}
+	case "reaction_added":
+		var ev slack.ReactionAddedEvent
+		if err = json.Unmarshal(raw, &ev); err == nil {
+			l.HandleReaction(&ev)
+		}
+	case "reaction_removed":
+		var ev slack.ReactionRemovedEvent
+		if err = json.Unmarshal(raw, &ev); err == nil {
+			l.HandleReactionRemoved(&ev)
+		}
+	}
+	if err != nil {
+		fmt.Printf("failed to decode %s event: %v\n", inner.Type, err)
+	}
+}
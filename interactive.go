@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Interactivity support. Slack POSTs button clicks to /slack/interactive, or
+// sends them down the Socket Mode connection, and we update the message the
+// buttons were on through the response_url that comes with the click.
+// See: https://api.slack.com/interactivity/handling
+
+type interactionPayload struct {
+	Type string `json:"type"`
+	User struct {
+		ID string `json:"id"`
+	} `json:"user"`
+	Channel struct {
+		ID string `json:"id"`
+	} `json:"channel"`
+	Message struct {
+		Text   string  `json:"text"`
+		Blocks []Block `json:"blocks"`
+	} `json:"message"`
+	ResponseURL string `json:"response_url"`
+	Actions     []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+}
+
+// interactionResponse either replaces the message the buttons were on, or
+// leaves it alone and adds a note only the clicker sees
+type interactionResponse struct {
+	ReplaceOriginal bool    `json:"replace_original"`
+	ResponseType    string  `json:"response_type,omitempty"`
+	Text            string  `json:"text"`
+	Blocks          []Block `json:"blocks,omitempty"`
+}
+
+// HandleInteraction receives button clicks. Like events they're
+// acknowledged straight away and handled in the background.
+func (l *Lorebot) HandleInteraction(w http.ResponseWriter, r *http.Request) {
+	if _, err := verifySlackRequest(r, l.SigningSecret); err != nil {
+		fmt.Printf("rejected interaction: %v\n", err)
+		http.Error(w, "invalid request", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+
+	var payload interactionPayload
+	if err := json.Unmarshal([]byte(r.PostForm.Get("payload")), &payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	go l.handleInteraction(payload)
+}
+
+// handleInteraction carries out a button click and updates the message
+func (l *Lorebot) handleInteraction(payload interactionPayload) {
+	if payload.Type != "block_actions" {
+		return
+	}
+	for _, action := range payload.Actions {
+		var resp interactionResponse
+		switch action.ActionID {
+		case "upvote_lore", "retract_vote":
+			resp = l.voteAction(payload, action.ActionID == "upvote_lore", action.Value)
+		case "run_command":
+			tokens := tokenTexts(tokenize(action.Value))
+			if len(tokens) == 0 {
+				continue
+			}
+			reply := l.RunCommand(tokens[0], tokens[1:])
+			resp = interactionResponse{ReplaceOriginal: true, Text: reply.Text, Blocks: reply.Blocks}
+		default:
+			// e.g. view_lore, which just opens a link
+			continue
+		}
+		if err := respond(payload.ResponseURL, resp); err != nil {
+			fmt.Printf("failed to respond to %s: %v\n", action.ActionID, err)
+		}
+	}
+}
+
+// voteAction upvotes, or takes back the clicker's vote on, the lore with
+// key, then re-renders it where it appears in the message
+func (l *Lorebot) voteAction(payload interactionPayload, upvote bool, key string) interactionResponse {
+	channelID, messageTS, ok := parseLoreKey(key)
+	if !ok {
+		return ephemeral("Sorry, I don't know which lore that is.")
+	}
+
+	if upvote {
+		err := l.Store.UpvoteLore(channelID, messageTS, payload.User.ID)
+		if err == ErrAlreadyVoted {
+			return ephemeral("You've already voted for that lore.")
+		}
+		if err == ErrNoLore {
+			return ephemeral("That lore is gone.")
+		}
+		if err != nil {
+			return ephemeral(friendlyError("failed to upvote lore", err))
+		}
+		upvotes.Inc("")
+	} else {
+		score, err := l.Store.RetractVote(channelID, messageTS, payload.User.ID)
+		if err == ErrNoVote {
+			return ephemeral("You haven't voted for that lore.")
+		}
+		if err != nil {
+			return ephemeral(friendlyError("failed to retract vote", err))
+		}
+		retractions.Inc("")
+		if err := l.applyZeroVotePolicy(channelID, messageTS, score); err != nil {
+			fmt.Printf("failed to apply zero vote policy: %v\n", err)
+		}
+	}
+
+	// A lore that's been hidden or deleted just disappears from the message
+	var replacement []Block
+	lore, err := l.Store.GetLore(channelID, messageTS)
+	if err == nil {
+		replacement = l.loreBlocks(lore)
+	} else if err != ErrNoLore {
+		return ephemeral(friendlyError("failed to get lore", err))
+	}
+	return interactionResponse{
+		ReplaceOriginal: true,
+		Text:            payload.Message.Text,
+		Blocks:          replaceLoreBlocks(payload.Message.Blocks, key, replacement),
+	}
+}
+
+func ephemeral(text string) interactionResponse {
+	return interactionResponse{ResponseType: "ephemeral", Text: text}
+}
+
+// respond POSTs to a response_url, which needs no token
+func respond(responseURL string, resp interactionResponse) error {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	r, err := webAPIClient.Post(responseURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("response_url returned %s", r.Status)
+	}
+	return nil
+}
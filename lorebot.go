@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -10,46 +11,124 @@ import (
 )
 
 type Lorebot struct {
-	Pg        *PostgresClient
-	SlackAPI  *slack.Client
-	LorebotID string
+	Store             LoreStore
+	SlackAPI          *slack.Client
+	LorebotID         string
+	Token             string
+	ZeroVotePolicy    string // see Configuration.ZeroVotePolicy
+	SigningSecret     string
+	SlashInChannel    bool
+	Transport         string // see Configuration.Transport
+	HTTPAddr          string
+	AppToken          string
+	ReplyMode         string // see Configuration.ReplyMode
+	CommandReplyModes map[string]string
+	MaxResults        int
+	Schedules         []scheduledJob
+
+	seenEvents seenEvents
+	avatars    avatarCache
 }
 
 type Message struct {
 	ChannelID string
 	Content   string
+	ThreadTS  string // reply in the thread under this message, if set
+	Blocks    []Block
 }
 
 func (l *Lorebot) SendMessage(msg Message) {
-	params := slack.PostMessageParameters{Username: "Lorebot", IconEmoji: ":lore:"}
-
 	fmt.Println("Attempting to send message: " + msg.Content)
+	if len(msg.Blocks) > 0 {
+		if err := l.postBlocks(msg); err != nil {
+			fmt.Printf("failed to post message: %v\n", err)
+		}
+		return
+	}
+
+	params := slack.PostMessageParameters{Username: "Lorebot", IconEmoji: ":lore:"}
+	params.ThreadTimestamp = msg.ThreadTS
 	_, _, err := l.SlackAPI.PostMessage(msg.ChannelID, msg.Content, params)
 	if err != nil {
+		slackAPIErrors.Inc("chat.postMessage")
 		fmt.Printf("failed to post message: %v\n", err)
 	}
 }
 
+// reportError logs a failure and lets the channel know something went wrong,
+// without taking the bot down
+func (l *Lorebot) reportError(channelID string, context string, err error) {
+	msg := Message{ChannelID: channelID, Content: friendlyError(context, err)}
+	l.SendMessage(msg)
+}
+
+// friendlyError logs a failure and returns what to tell the user about it
+func friendlyError(context string, err error) string {
+	fmt.Printf("%s: %v\n", context, err)
+	return "Sorry, I couldn't reach the lore archive. Please try again later."
+}
+
 // channel + timestamp is a UUID for slack.
-// So when someone lore reacts, we look up the channel history at that timestamp
-// See: https://api.slack.com/methods/channels.history
-func (l *Lorebot) HandleLoreReact(channelId string, timestamp string) {
-	params := slack.HistoryParameters{
-		Latest:    timestamp,
-		Count:     1,
-		Inclusive: true,
-	}
-	history, err := l.SlackAPI.GetChannelHistory(channelId, params)
+// So when someone lore reacts, we look up the conversation history at that
+// timestamp. Threaded replies don't show up in the channel's history, so if
+// it isn't there we look for it among the thread replies instead. Both work
+// for public and private channels, group DMs and DMs.
+// See: https://api.slack.com/methods/conversations.history
+// See: https://api.slack.com/methods/conversations.replies
+func (l *Lorebot) fetchMessage(channelId string, timestamp string) (*webMessage, bool) {
+	history, err := l.conversationMessages("conversations.history", url.Values{
+		"channel":   {channelId},
+		"latest":    {timestamp},
+		"oldest":    {timestamp},
+		"limit":     {"1"},
+		"inclusive": {"true"},
+	})
+	if err != nil {
+		fmt.Printf("failed to get conversation history: %v\n", err)
+		return nil, false
+	}
+	for i := range history {
+		if history[i].Timestamp == timestamp {
+			return &history[i], true
+		}
+	}
+
+	replies, err := l.conversationMessages("conversations.replies", url.Values{
+		"channel":   {channelId},
+		"ts":        {timestamp},
+		"latest":    {timestamp},
+		"oldest":    {timestamp},
+		"inclusive": {"true"},
+	})
 	if err != nil {
-		fmt.Printf("failed to get channel history: %v\n", err)
+		fmt.Printf("failed to get conversation replies: %v\n", err)
+		return nil, false
+	}
+	for i := range replies {
+		if replies[i].Timestamp == timestamp {
+			return &replies[i], true
+		}
+	}
+
+	fmt.Printf("no message found in channel %s at time %s\n", channelId, timestamp)
+	return nil, false
+}
+
+func (l *Lorebot) HandleLoreReact(channelId string, timestamp string, reactor string) {
+	exists, err := l.Store.LoreExists(channelId, timestamp)
+	if err != nil {
+		l.reportError(channelId, "failed to check for existing lore", err)
 		return
 	}
-	if len(history.Messages) != 1 {
-		fmt.Printf("no message found in channel %s at time %s\n", channelId, timestamp)
+	if exists {
+		l.upvoteReact(channelId, timestamp, reactor)
 		return
 	}
 
-	message := history.Messages[0]
+	message, ok := l.fetchMessage(channelId, timestamp)
+	if !ok {
+		return
+	}
 
 	// Can't lore the lorebot
 	if message.User == "" {
@@ -57,111 +136,433 @@ func (l *Lorebot) HandleLoreReact(channelId string, timestamp string) {
 		return
 	}
 
-	if l.Pg.LoreExists(message.Text, message.User) {
-		l.Pg.UpvoteLore(message.User, message.Text)
-		return
-	}
-
 	fmt.Println("User: " + message.User + " + lore id: " + l.LorebotID)
 
-	l.Pg.InsertLore(message.User, message.Text)
-	msg := Message{ChannelID: channelId, Content: "Lore added: <@" + message.User + ">: " + message.Text}
+	permalink, err := l.GetPermalink(channelId, timestamp)
+	if err != nil {
+		// Not worth losing the lore over, it just won't link back
+		fmt.Printf("failed to get permalink: %v\n", err)
+	}
+
+	lore := Lore{
+		userID:      message.User,
+		Message:     message.Text,
+		ChannelID:   channelId,
+		MessageTS:   timestamp,
+		Permalink:   permalink,
+		Attachments: messageAttachments(message),
+	}
+	err = l.Store.InsertLore(lore, reactor)
+	if err == ErrLoreExists {
+		// Someone else lored it while we were fetching it
+		l.upvoteReact(channelId, timestamp, reactor)
+		return
+	}
+	if err != nil {
+		l.reportError(channelId, "failed to insert lore", err)
+		return
+	}
+	loresAdded.Inc("")
+	// Confirm in the lored message's thread, or start one under it
+	thread := message.ThreadTimestamp
+	if thread == "" {
+		thread = timestamp
+	}
+	msg := Message{
+		ChannelID: channelId,
+		Content:   "Lore added: <@" + message.User + ">: " + message.Text + formatAttachments(lore.Attachments),
+		ThreadTS:  thread,
+	}
 	l.SendMessage(msg)
 	return
 }
 
+// upvoteReact counts a :lore: reaction on a message that's already lore
+func (l *Lorebot) upvoteReact(channelId string, timestamp string, reactor string) {
+	err := l.Store.UpvoteLore(channelId, timestamp, reactor)
+	if err == ErrAlreadyVoted {
+		fmt.Printf("Ignoring repeat vote from %s\n", reactor)
+		return
+	}
+	if err != nil {
+		l.reportError(channelId, "failed to upvote lore", err)
+		return
+	}
+	upvotes.Inc("")
+}
+
+// HandleLoreUnreact retracts reactor's vote when they remove their :lore:
+// reaction, then applies the zero vote policy if nobody is left voting for it.
+func (l *Lorebot) HandleLoreUnreact(channelId string, timestamp string, reactor string) {
+	score, err := l.Store.RetractVote(channelId, timestamp, reactor)
+	if err == ErrNoVote {
+		fmt.Printf("No vote from %s to retract\n", reactor)
+		return
+	}
+	if err != nil {
+		l.reportError(channelId, "failed to retract vote", err)
+		return
+	}
+	retractions.Inc("")
+	if err := l.applyZeroVotePolicy(channelId, timestamp, score); err != nil {
+		l.reportError(channelId, "failed to apply zero vote policy", err)
+	}
+}
+
+// applyZeroVotePolicy hides or deletes a lore whose score has dropped to
+// zero, if configured to
+func (l *Lorebot) applyZeroVotePolicy(channelId string, timestamp string, score int) error {
+	if score > 0 {
+		return nil
+	}
+	switch l.ZeroVotePolicy {
+	case "hide":
+		return l.Store.HideLore(channelId, timestamp)
+	case "delete":
+		return l.Store.DeleteLore(channelId, timestamp)
+	}
+	return nil
+}
+
 func (l *Lorebot) HandleMessage(ev *slack.MessageEvent) {
-	spl := strings.Split(ev.Text, " ")
-	if len(spl) < 2 {
+	tokens, ok := l.messageCommand(ev)
+	if !ok {
 		return
 	}
-	userID := parseUserID(spl[0])
-	if userID == l.LorebotID {
-		cmd := spl[1]
-		var lores []Lore = nil
-		switch cmd {
-		case "help":
-			out := "Usage: @lorebot <help | random | recent | search <query> | top | user <username> | highscores>"
-			msg := Message{ChannelID: ev.Channel, Content: out}
-			l.SendMessage(msg)
-			return
-		case "random":
-			lores = l.Pg.RandomLore()
-		case "recent":
-			lores = l.Pg.RecentLore()
-		case "user":
-			if len(spl) != 3 {
-				return
-			}
-			parsedUser := parseUserID(spl[2])
-			lores = l.Pg.LoreForUser(parsedUser)
-		case "search":
-			if len(spl) < 3 {
-				return
-			}
-			query := strings.Join(spl[2:], " ")
-			lores = l.Pg.SearchLore(query)
-		case "top":
-			lores = l.Pg.TopLore()
-		case "highscores":
-			highscores := l.Pg.Highscores()
-			out := ""
-			for _, highscore := range highscores {
-				out += "<@" + highscore.UserID + ">" + ": " + strconv.Itoa(highscore.Score) + "\n"
+	reply := l.RunCommand(tokens[0].Text, tokenTexts(tokens[1:]))
+	if reply.Text != "" {
+		msg := Message{
+			ChannelID: ev.Channel,
+			Content:   reply.Text,
+			ThreadTS:  l.replyThread(ev, tokens[0].Text),
+			Blocks:    reply.Blocks,
+		}
+		l.SendMessage(msg)
+	}
+}
+
+// replyThread decides where to answer a command: in the thread it was asked
+// in, in a new thread under it if the reply mode for the command says so,
+// or otherwise at the top level of the channel (an empty thread).
+func (l *Lorebot) replyThread(ev *slack.MessageEvent, cmdName string) string {
+	if ev.ThreadTimestamp != "" {
+		return ev.ThreadTimestamp
+	}
+	mode := l.ReplyMode
+	if cmd, ok := commands.Lookup(cmdName); ok {
+		if override, ok := l.CommandReplyModes[cmd.Name]; ok {
+			mode = override
+		}
+	}
+	if mode == "thread" {
+		return ev.Timestamp
+	}
+	return ""
+}
+
+// messageCommand finds the command, if any, that a message is giving us
+func (l *Lorebot) messageCommand(ev *slack.MessageEvent) ([]token, bool) {
+	// Never answer ourselves or other bots, or edits and deletions. In a DM
+	// that would be an endless conversation.
+	if ev.BotID != "" || ev.SubType == "bot_message" || ev.Hidden || ev.User == l.LorebotID {
+		return nil, false
+	}
+
+	all := tokenize(ev.Text)
+	tokens, ok := commandTokens(all, l.LorebotID)
+	if ok && all[0].UserID != l.LorebotID {
+		// "top @lorebot" is a command, but "thanks @lorebot" is just chat
+		if _, known := commands.Lookup(tokens[0].Text); !known {
+			ok = false
+		}
+	}
+	if !ok && isDirectMessage(ev.Channel) {
+		// Everything in a DM is addressed to us, no mention needed
+		tokens, ok = tokenize(ev.Text), true
+	}
+	return tokens, ok && len(tokens) > 0
+}
+
+// DM channel IDs start with D
+func isDirectMessage(channelID string) bool {
+	return strings.HasPrefix(channelID, "D")
+}
+
+// RunCommand runs one of the bot's commands and returns the reply. It's
+// shared by every way of talking to the bot (mentions, slash commands), so
+// it doesn't post anything itself. An empty reply means there's nothing to
+// say.
+func (l *Lorebot) RunCommand(cmd string, args []string) Reply {
+	return commands.Run(l, cmd, args)
+}
+
+// resolveSearchFilter looks up the IDs for from: and in: filters given as
+// plain names rather than Slack mentions
+func (l *Lorebot) resolveSearchFilter(filter *SearchFilter) error {
+	if filter.UserName != "" {
+		users, err := l.SlackAPI.GetUsers()
+		if err != nil {
+			slackAPIErrors.Inc("users.list")
+			return fmt.Errorf("failed to look up @%s", filter.UserName)
+		}
+		for _, user := range users {
+			if strings.EqualFold(user.Name, filter.UserName) || strings.EqualFold(user.Profile.DisplayName, filter.UserName) {
+				filter.UserID = user.ID
+				break
 			}
-			msg := Message{ChannelID: ev.Channel, Content: out}
-			l.SendMessage(msg)
 		}
+		if filter.UserID == "" {
+			return fmt.Errorf("no user called @%s", filter.UserName)
+		}
+	}
 
-		// If we have some lores to share, send them to slack
-		if lores != nil {
-			out := ""
-			for _, lore := range lores {
-				out += "<@" + lore.userID + ">" + ": " + lore.Message + " (" + strconv.Itoa(lore.Score) + ")" + "\n"
+	if filter.ChannelName != "" {
+		params := &slack.GetConversationsParameters{
+			ExcludeArchived: "true",
+			Limit:           200,
+			Types:           []string{"public_channel", "private_channel"},
+		}
+		for filter.ChannelID == "" {
+			channels, cursor, err := l.SlackAPI.GetConversations(params)
+			if err != nil {
+				slackAPIErrors.Inc("conversations.list")
+				return fmt.Errorf("failed to look up #%s", filter.ChannelName)
+			}
+			for _, channel := range channels {
+				if strings.EqualFold(channel.Name, filter.ChannelName) {
+					filter.ChannelID = channel.ID
+					break
+				}
+			}
+			if cursor == "" {
+				break
 			}
-			msg := Message{ChannelID: ev.Channel, Content: out}
-			l.SendMessage(msg)
+			params.Cursor = cursor
+		}
+		if filter.ChannelID == "" {
+			return fmt.Errorf("no channel called #%s", filter.ChannelName)
 		}
 	}
+	return nil
 }
 
 func (l *Lorebot) HandleReaction(ev *slack.ReactionAddedEvent) {
 	if ev.Reaction == "lore" {
 		channel := ev.Item.Channel
 		timestamp := ev.Item.Timestamp
-		l.HandleLoreReact(channel, timestamp)
+		l.HandleLoreReact(channel, timestamp, ev.User)
 	}
 }
 
+func (l *Lorebot) HandleReactionRemoved(ev *slack.ReactionRemovedEvent) {
+	if ev.Reaction == "lore" {
+		l.HandleLoreUnreact(ev.Item.Channel, ev.Item.Timestamp, ev.User)
+	}
+}
+
+// Start receives events from Slack over the configured transport, serving
+// the HTTP endpoints alongside if there are any. It blocks.
 func (l *Lorebot) Start() {
+	l.startScheduler()
+	switch l.Transport {
+	case "events":
+		l.ServeSlack(l.HTTPAddr)
+	case "socket":
+		if l.HTTPAddr != "" {
+			go l.ServeSlack(l.HTTPAddr)
+		}
+		l.startSocketMode()
+	default:
+		if l.HTTPAddr != "" {
+			go l.ServeSlack(l.HTTPAddr)
+		}
+		l.startRTM()
+	}
+}
+
+func (l *Lorebot) startRTM() {
 	rtm := l.SlackAPI.NewRTM()
 	go rtm.ManageConnection()
 	for msg := range rtm.IncomingEvents {
 		switch ev := msg.Data.(type) {
+		case *slack.ConnectedEvent:
+			if ev.ConnectionCount > 1 {
+				rtmReconnects.Inc("")
+			}
 		case *slack.MessageEvent:
 			go l.HandleMessage(ev)
 		case *slack.InvalidAuthEvent:
 			log.Fatal("Invalid credentials")
 		case *slack.ReactionAddedEvent:
 			go l.HandleReaction(ev)
+		case *slack.ReactionRemovedEvent:
+			go l.HandleReactionRemoved(ev)
+		}
+	}
+}
+
+// messageAttachments collects the uploaded file and any attachments on a
+// message, which is often all there is to an image lore
+func messageAttachments(message *webMessage) []LoreAttachment {
+	ret := make([]LoreAttachment, 0)
+	files := message.Files
+	if message.File != nil && len(files) == 0 {
+		// Older messages have a single file instead
+		files = []slack.File{*message.File}
+	}
+	for _, f := range files {
+		ret = append(ret, LoreAttachment{
+			Kind:      "file",
+			Name:      f.Name,
+			Permalink: f.Permalink,
+			Mimetype:  f.Mimetype,
+		})
+	}
+	for _, a := range message.Attachments {
+		text := a.Text
+		if text == "" {
+			text = a.Fallback
 		}
+		ret = append(ret, LoreAttachment{
+			Kind:      "attachment",
+			Name:      a.Title,
+			Permalink: a.TitleLink,
+			Text:      text,
+		})
+	}
+	return ret
+}
+
+// formatLore renders a lore as a line, linking back to the original
+// message when we know where it is, followed by a line per attachment
+func formatLore(lore Lore) string {
+	out := "<@" + lore.userID + ">" + ": " + lore.Message + " (" + strconv.Itoa(lore.Score) + ")"
+	if lore.Permalink != "" {
+		out += " <" + lore.Permalink + "|view>"
+	}
+	return out + formatAttachments(lore.Attachments)
+}
+
+func formatLores(lores []Lore) string {
+	out := ""
+	for _, lore := range lores {
+		out += formatLore(lore) + "\n"
 	}
+	return out
 }
 
+func formatAttachments(attachments []LoreAttachment) string {
+	out := ""
+	for _, a := range attachments {
+		name := a.Name
+		if name == "" {
+			name = a.Kind
+		}
+		if a.Permalink != "" {
+			name = "<" + a.Permalink + "|" + name + ">"
+		}
+		out += "\n> :paperclip: " + name
+		if a.Mimetype != "" {
+			out += " (" + a.Mimetype + ")"
+		}
+		if a.Text != "" {
+			out += ": " + strings.Replace(a.Text, "\n", " ", -1)
+		}
+	}
+	return out
+}
+
+// parseUserID pulls the user ID out of a mention like <@U123> or
+// <@U123|name>, also accepting @U123 and a bare U123
 func parseUserID(unparsed string) string {
-	userID := strings.Replace(unparsed, "<", "", 1)
-	userID = strings.Replace(userID, ">", "", 1)
-	userID = strings.Replace(userID, "@", "", 1)
+	userID := strings.TrimSpace(unparsed)
+	userID = strings.TrimPrefix(userID, "<")
+	userID = strings.TrimSuffix(userID, ">")
+	userID = strings.TrimPrefix(userID, "@")
+	if bar := strings.IndexByte(userID, '|'); bar >= 0 {
+		userID = userID[:bar]
+	}
 	return userID
 }
 
 func NewLorebot(conf *Configuration) *Lorebot {
+	switch conf.ZeroVotePolicy {
+	case "", "keep", "hide", "delete":
+	default:
+		log.Fatalf("unknown zero vote policy: %s", conf.ZeroVotePolicy)
+	}
+	for name, mode := range conf.CommandReplyModes {
+		// Modes are looked up by a command's name, not its aliases
+		if cmd, ok := commands.Lookup(name); !ok || cmd.Name != name {
+			log.Fatalf("unknown command in CommandReplyModes: %s", name)
+		}
+		if mode != "channel" && mode != "thread" {
+			log.Fatalf("unknown reply mode: %s", mode)
+		}
+	}
+	switch conf.ReplyMode {
+	case "", "channel", "thread":
+	default:
+		log.Fatalf("unknown reply mode: %s", conf.ReplyMode)
+	}
+	if conf.MaxResults < 0 {
+		log.Fatalf("MaxResults can't be negative: %d", conf.MaxResults)
+	}
+	switch conf.Transport {
+	case "", "rtm":
+	case "events":
+		if conf.HTTPAddr == "" || conf.SigningSecret == "" {
+			log.Fatal("the events transport needs HTTPAddr and SigningSecret")
+		}
+	case "socket":
+		if conf.AppToken == "" {
+			log.Fatal("the socket transport needs AppToken")
+		}
+	default:
+		log.Fatalf("unknown transport: %s", conf.Transport)
+	}
+
+	schedules, err := parseSchedules(conf.Schedules)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	bot := Lorebot{
-		Pg:        NewPostgresClient(conf),
-		SlackAPI:  slack.New(conf.Token),
-		LorebotID: conf.BotID,
+		Store:             NewLoreStore(conf),
+		SlackAPI:          slack.New(conf.Token),
+		LorebotID:         conf.BotID,
+		Token:             conf.Token,
+		ZeroVotePolicy:    conf.ZeroVotePolicy,
+		SigningSecret:     conf.SigningSecret,
+		SlashInChannel:    conf.SlashInChannel,
+		Transport:         conf.Transport,
+		HTTPAddr:          conf.HTTPAddr,
+		AppToken:          conf.AppToken,
+		ReplyMode:         conf.ReplyMode,
+		CommandReplyModes: conf.CommandReplyModes,
+		MaxResults:        conf.MaxResults,
+		Schedules:         schedules,
 	}
 	bot.SlackAPI.SetDebug(true)
 
 	return &bot
 }
+
+// NewLoreStore picks the storage backend named in the configuration,
+// defaulting to Postgres.
+func NewLoreStore(conf *Configuration) LoreStore {
+	switch conf.Store {
+	case "memory":
+		fmt.Println("Using in-memory lore store, lore will not survive a restart")
+		return NewMemoryStore()
+	case "", "postgres":
+		pg, err := NewPostgresClient(conf)
+		if err != nil {
+			log.Fatalf("failed to connect to postgres: %v", err)
+		}
+		return pg
+	default:
+		log.Fatalf("unknown store: %s", conf.Store)
+	}
+	return nil
+}
@@ -9,18 +9,54 @@ import (
 )
 
 type Configuration struct {
-	Token      string
-	PGHost     string
-	PGPort     int
-	PGUser     string
-	PGPassword string
-	PGDbname   string
-	BotID      string
+	Token       string
+	PGHost      string
+	PGPort      int
+	PGUser      string
+	PGPassword  string
+	PGDbname    string
+	BotID       string
+	Store       string // "postgres" (default) or "memory"
+	MetricsAddr string // listen address for /metrics, e.g. ":9090"; empty disables it
+	// What to do with a lore once its last vote is retracted: "keep"
+	// (default), "hide" or "delete"
+	ZeroVotePolicy string
+	// Listen address for the endpoints Slack calls, e.g. ":8080"; empty
+	// disables them. Requests are verified with SigningSecret.
+	HTTPAddr      string
+	SigningSecret string
+	// Post /lore replies to the whole channel rather than just the caller
+	SlashInChannel bool
+	// How events reach the bot: "rtm" (default), "events", which has Slack
+	// POST them to HTTPAddr, or "socket", which connects out to Slack using
+	// the app-level AppToken
+	Transport string
+	AppToken  string
+	// Where to answer commands: "channel" (default) posts at the top level,
+	// "thread" replies in a thread on the command. CommandReplyModes
+	// overrides it per command, e.g. {"search": "thread"}.
+	ReplyMode         string
+	CommandReplyModes map[string]string
+	// The most lores `top 10`, `recent 5` or `random 3` may ask for at
+	// once. Defaults to 10.
+	MaxResults int
+	// Jobs to run on a schedule, e.g.
+	// {"Job": "lore_of_the_day", "Cron": "0 9 * * 1-5", "Channel": "C012AB3CD"}
+	// Cron expressions are in the server's local time.
+	Schedules []ScheduleConfig
+}
+
+type ScheduleConfig struct {
+	Job     string // "lore_of_the_day", "weekly_digest" or "on_this_day"
+	Cron    string
+	Channel string
 }
 
 func main() {
 	fmt.Println("Starting lorebot")
 	confPath := flag.String("conf", "conf.json", "Path to json configuration file")
+	migrateOnly := flag.Bool("migrate-only", false, "Apply pending schema migrations and exit")
+	migrateDown := flag.Int("migrate-down", 0, "Revert this many schema migrations and exit")
 	flag.Parse()
 
 	file, err := os.Open(*confPath)
@@ -34,6 +70,27 @@ func main() {
 		log.Fatalf("failed to unmarshal config: %v", err)
 	}
 
+	if *migrateOnly || *migrateDown > 0 {
+		db, err := DB(&conf)
+		if err != nil {
+			log.Fatalf("failed to connect to postgres: %v", err)
+		}
+		if *migrateDown > 0 {
+			err = MigrateDown(db, *migrateDown)
+		} else {
+			err = MigrateUp(db)
+		}
+		if err != nil {
+			log.Fatalf("failed to migrate: %v", err)
+		}
+		fmt.Println("Migrations complete")
+		return
+	}
+
+	if conf.MetricsAddr != "" {
+		go ServeMetrics(conf.MetricsAddr)
+	}
+
 	lorebot := NewLorebot(&conf)
 	lorebot.Start()
 }
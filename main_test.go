@@ -1,7 +1,21 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nlopes/slack"
 )
 
 func TestParseUserID(t *testing.T) {
@@ -17,6 +31,26 @@ func TestParseUserID(t *testing.T) {
 			input:    "<@U123ABC>",
 			expected: "U123ABC",
 		},
+		{
+			desc:     "With name",
+			input:    "<@U123ABC|alice>",
+			expected: "U123ABC",
+		},
+		{
+			desc:     "Bare at",
+			input:    "@U123ABC",
+			expected: "U123ABC",
+		},
+		{
+			desc:     "Bare ID",
+			input:    "U123ABC",
+			expected: "U123ABC",
+		},
+		{
+			desc:     "Whitespace",
+			input:    " <@U123ABC>\n",
+			expected: "U123ABC",
+		},
 	}
 
 	for _, tc := range tt {
@@ -29,3 +63,1247 @@ func TestParseUserID(t *testing.T) {
 		})
 	}
 }
+
+func TestTokenize(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		desc     string
+		input    string
+		expected []token
+	}{
+		{
+			desc:     "Empty",
+			input:    "  \n ",
+			expected: []token{},
+		},
+		{
+			desc:  "Extra whitespace",
+			input: "<@UBOT>  search\tpizza\n party",
+			expected: []token{
+				{Text: "<@UBOT>", UserID: "UBOT"},
+				{Text: "search"},
+				{Text: "pizza"},
+				{Text: "party"},
+			},
+		},
+		{
+			desc:  "Quotes",
+			input: `search "free pizza" “curly quotes” "unterminated`,
+			expected: []token{
+				{Text: "search"},
+				{Text: "free pizza", Quoted: true},
+				{Text: "curly quotes", Quoted: true},
+				{Text: "unterminated", Quoted: true},
+			},
+		},
+		{
+			desc:  "Mentions with names",
+			input: "user <@U123|alice> <#C456|general>",
+			expected: []token{
+				{Text: "user"},
+				{Text: "<@U123|alice>", UserID: "U123"},
+				{Text: "<#C456|general>"},
+			},
+		},
+		{
+			desc:  "Markup labels with spaces",
+			input: "see <https://example.com|the example site> now",
+			expected: []token{
+				{Text: "see"},
+				{Text: "<https://example.com|the example site>"},
+				{Text: "now"},
+			},
+		},
+		{
+			desc:  "Markup inside a word",
+			input: "from:<@U123|alice> in:<#C456>",
+			expected: []token{
+				{Text: "from:<@U123|alice>"},
+				{Text: "in:<#C456>"},
+			},
+		},
+		{
+			desc:  "Entities",
+			input: "search fish &amp; chips &lt;3 \"a &gt; b\"",
+			expected: []token{
+				{Text: "search"},
+				{Text: "fish"},
+				{Text: "&"},
+				{Text: "chips"},
+				{Text: "<3"},
+				{Text: "a > b", Quoted: true},
+			},
+		},
+		{
+			desc:  "Unclosed angle bracket",
+			input: "a<b c",
+			expected: []token{
+				{Text: "a<b"},
+				{Text: "c"},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			out := tokenize(tc.input)
+
+			if !reflect.DeepEqual(out, tc.expected) {
+				t.Fatalf("expected: '%+v', got: '%+v'", tc.expected, out)
+			}
+		})
+	}
+}
+
+func TestCommandTokens(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		desc     string
+		input    string
+		expected []string
+		ok       bool
+	}{
+		{
+			desc:     "Leading mention",
+			input:    "<@UBOT> user <@U123>",
+			expected: []string{"user", "<@U123>"},
+			ok:       true,
+		},
+		{
+			desc:  "Mention mid message",
+			input: "hey <@UBOT|lorebot> random",
+			ok:    false,
+		},
+		{
+			desc:  "Mention mid sentence",
+			input: "ask <@UBOT> for the top lore",
+			ok:    false,
+		},
+		{
+			desc:  "Bare mention",
+			input: "<@UBOT>",
+			ok:    false,
+		},
+		{
+			desc:     "Trailing mention",
+			input:    "top <@UBOT>",
+			expected: []string{"top"},
+			ok:       true,
+		},
+		{
+			desc:  "Someone else",
+			input: "<@U123> random",
+			ok:    false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			tokens, ok := commandTokens(tokenize(tc.input), "UBOT")
+
+			if ok != tc.ok {
+				t.Fatalf("expected ok: %v, got: %v", tc.ok, ok)
+			}
+			if ok && !reflect.DeepEqual(tokenTexts(tokens), tc.expected) {
+				t.Fatalf("expected: '%v', got: '%v'", tc.expected, tokenTexts(tokens))
+			}
+		})
+	}
+}
+
+func TestJoinArgs(t *testing.T) {
+	t.Parallel()
+
+	out := joinArgs(tokenTexts(tokenize(`"free pizza" -pineapple`)))
+	if out != `"free pizza" -pineapple` {
+		t.Fatalf("expected quoted phrase to survive, got: %s", out)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore()
+	store.InsertLore(Lore{userID: "U1", Message: "first", ChannelID: "C1", MessageTS: "1.1"}, "U3")
+	store.InsertLore(Lore{userID: "U2", Message: "second", ChannelID: "C1", MessageTS: "1.2"}, "U3")
+
+	if exists, _ := store.LoreExists("C1", "1.1"); !exists {
+		t.Fatalf("expected lore to exist")
+	}
+	if exists, _ := store.LoreExists("C2", "1.1"); exists {
+		t.Fatalf("expected lore to be keyed by channel")
+	}
+
+	if err := store.UpvoteLore("C1", "1.2", "U1"); err != nil {
+		t.Fatalf("unexpected error upvoting: %v", err)
+	}
+	if err := store.UpvoteLore("C1", "1.2", "U1"); err != ErrAlreadyVoted {
+		t.Fatalf("expected repeat vote to be rejected, got: %v", err)
+	}
+	if err := store.UpvoteLore("C1", "1.2", "U3"); err != ErrAlreadyVoted {
+		t.Fatalf("expected adder's vote to count, got: %v", err)
+	}
+	if err := store.UpvoteLore("C9", "9.9", "U1"); err != ErrNoLore {
+		t.Fatalf("expected voting on unknown lore to fail, got: %v", err)
+	}
+	if err := store.InsertLore(Lore{userID: "U2", Message: "second", ChannelID: "C1", MessageTS: "1.2"}, "U4"); err != ErrLoreExists {
+		t.Fatalf("expected lore to be added only once, got: %v", err)
+	}
+	top, _ := store.TopLore(time.Time{}, 3, 0)
+	if len(top) != 2 || top[0].Message != "second" || top[0].Score != 2 {
+		t.Fatalf("unexpected top lore: %+v", top)
+	}
+
+	highscores, _ := store.Highscores(time.Time{}, 10, 0)
+	if len(highscores) != 2 || highscores[0].UserID != "U2" {
+		t.Fatalf("unexpected highscores: %+v", highscores)
+	}
+
+	found, _ := store.SearchLore("FIR", 10, 0)
+	if len(found) != 1 || found[0].Message != "first" {
+		t.Fatalf("unexpected search results: %+v", found)
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	t.Parallel()
+
+	h := newHistogramVec("test_seconds", "Test.", "method", []float64{0.1, 1})
+	h.Observe("Query", 0.05)
+	h.Observe("Query", 0.5)
+	h.Observe("Query", 5)
+
+	var sb strings.Builder
+	h.writeTo(&sb)
+	out := sb.String()
+
+	for _, line := range []string{
+		`test_seconds_bucket{method="Query",le="0.1"} 1`,
+		`test_seconds_bucket{method="Query",le="1"} 2`,
+		`test_seconds_bucket{method="Query",le="+Inf"} 3`,
+		`test_seconds_count{method="Query"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("expected %q in output:\n%s", line, out)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	t.Parallel()
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("failed to load migrations: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatalf("expected at least one migration")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("expected migration %d to have version %d, got %d", i, i+1, m.Version)
+		}
+		if m.Down == "" {
+			t.Fatalf("migration %d_%s has no down script", m.Version, m.Name)
+		}
+	}
+}
+
+func TestMemoryStoreRetractVote(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore()
+	store.InsertLore(Lore{userID: "U1", Message: "lore", ChannelID: "C1", MessageTS: "1.1"}, "U2")
+
+	if _, err := store.RetractVote("C1", "1.1", "U3"); err != ErrNoVote {
+		t.Fatalf("expected ErrNoVote, got: %v", err)
+	}
+	score, err := store.RetractVote("C1", "1.1", "U2")
+	if err != nil || score != 0 {
+		t.Fatalf("expected score 0, got: %v (%v)", score, err)
+	}
+
+	store.HideLore("C1", "1.1")
+	if recent, _ := store.RecentLore(3, 0); len(recent) != 0 {
+		t.Fatalf("expected hidden lore to be left out, got: %+v", recent)
+	}
+	store.UpvoteLore("C1", "1.1", "U3")
+	if recent, _ := store.RecentLore(3, 0); len(recent) != 1 {
+		t.Fatalf("expected upvote to unhide lore, got: %+v", recent)
+	}
+}
+
+func TestFormatLore(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		desc     string
+		input    Lore
+		expected string
+	}{
+		{
+			desc:     "Legacy",
+			input:    Lore{userID: "U1", Message: "hello", Score: 2},
+			expected: "<@U1>: hello (2)",
+		},
+		{
+			desc:     "Permalink",
+			input:    Lore{userID: "U1", Message: "hello", Score: 2, Permalink: "https://x.slack.com/p1"},
+			expected: "<@U1>: hello (2) <https://x.slack.com/p1|view>",
+		},
+		{
+			desc: "Attachments",
+			input: Lore{userID: "U1", Score: 1, Attachments: []LoreAttachment{
+				{Kind: "file", Name: "cat.png", Permalink: "https://x.slack.com/f1", Mimetype: "image/png"},
+				{Kind: "attachment", Text: "line one\nline two"},
+			}},
+			expected: "<@U1>:  (1)\n> :paperclip: <https://x.slack.com/f1|cat.png> (image/png)\n> :paperclip: attachment: line one line two",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			out := formatLore(tc.input)
+
+			if out != tc.expected {
+				t.Fatalf("expected: '%v', got: '%v'", tc.expected, out)
+			}
+		})
+	}
+}
+
+func TestParseSearchTerms(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		desc     string
+		input    string
+		expected searchTerms
+	}{
+		{
+			desc:     "Words",
+			input:    "Pizza  party",
+			expected: searchTerms{Words: []string{"pizza", "party"}},
+		},
+		{
+			desc:     "Phrase and negation",
+			input:    `"free   pizza" -pineapple`,
+			expected: searchTerms{Phrases: []string{"free pizza"}, Excluded: []string{"pineapple"}},
+		},
+		{
+			desc:     "Curly quotes",
+			input:    "“free pizza” today",
+			expected: searchTerms{Words: []string{"today"}, Phrases: []string{"free pizza"}},
+		},
+		{
+			desc:     "Unterminated quote",
+			input:    `say "hello there`,
+			expected: searchTerms{Words: []string{"say"}, Phrases: []string{"hello there"}},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			out := parseSearchTerms(tc.input)
+
+			if !reflect.DeepEqual(out, tc.expected) {
+				t.Fatalf("expected: '%+v', got: '%+v'", tc.expected, out)
+			}
+		})
+	}
+}
+
+func TestParseSearchPage(t *testing.T) {
+	t.Parallel()
+
+	args, page := parseSearchPage([]string{"pizza", "page", "2"})
+	if page != 2 || !reflect.DeepEqual(args, []string{"pizza"}) {
+		t.Fatalf("expected page 2 of pizza, got page %d of %v", page, args)
+	}
+	args, page = parseSearchPage([]string{"page", "2"})
+	if page != 1 || len(args) != 2 {
+		t.Fatalf("expected a bare 'page 2' to be the query, got page %d of %v", page, args)
+	}
+}
+
+func TestParseSearchFilter(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		desc     string
+		input    string
+		expected SearchFilter
+	}{
+		{
+			desc:     "Text only",
+			input:    "pizza time",
+			expected: SearchFilter{Query: "pizza time"},
+		},
+		{
+			desc:  "Mentions",
+			input: "pizza from:<@U123|alice> in:<#C456|general>",
+			expected: SearchFilter{
+				Query:     "pizza",
+				UserID:    "U123",
+				ChannelID: "C456",
+			},
+		},
+		{
+			desc:  "Plain names",
+			input: "from:@alice in:#general",
+			expected: SearchFilter{
+				UserName:    "alice",
+				ChannelName: "general",
+			},
+		},
+		{
+			desc:  "Dates and score",
+			input: "after:2024-01-01 before:2024-02-01 score:>3 ratio:2",
+			expected: SearchFilter{
+				Query:    "ratio:2",
+				Since:    time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+				Before:   time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+				MinScore: 4,
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			out, err := parseSearchFilter(strings.Fields(tc.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(out, tc.expected) {
+				t.Fatalf("expected: '%+v', got: '%+v'", tc.expected, out)
+			}
+		})
+	}
+
+	if _, err := parseSearchFilter([]string{"after:yesterday"}); err == nil {
+		t.Fatalf("expected an error for a bad date")
+	}
+}
+
+// signedRequest builds a request signed the way Slack signs them
+func signedRequest(method string, target string, body string, secret string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":" + body))
+	r.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestSlashCommand(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore()
+	store.InsertLore(Lore{userID: "U1", Message: "pizza is lore", ChannelID: "C1", MessageTS: "1.1"}, "U2")
+	bot := &Lorebot{Store: store, SigningSecret: "secret"}
+	server := httptest.NewServer(bot.HTTPHandler())
+	defer server.Close()
+
+	tt := []struct {
+		desc         string
+		body         string
+		secret       string
+		status       int
+		responseType string
+		text         string
+	}{
+		{
+			desc:         "Ephemeral",
+			body:         "command=%2Flore&text=recent",
+			secret:       "secret",
+			status:       http.StatusOK,
+			responseType: "ephemeral",
+			text:         "<@U1>: pizza is lore (1)\n",
+		},
+		{
+			desc:         "Shared",
+			body:         "command=%2Flore&text=share+search+pizza",
+			secret:       "secret",
+			status:       http.StatusOK,
+			responseType: "in_channel",
+			text:         "<@U1>: pizza is lore (1)\n",
+		},
+		{
+			desc:   "Bad signature",
+			body:   "command=%2Flore&text=recent",
+			secret: "wrong",
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := signedRequest("POST", server.URL+"/slack/commands", tc.body, tc.secret)
+			r.RequestURI = ""
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, resp.StatusCode)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			var out slashResponse
+			if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if out.ResponseType != tc.responseType || out.Text != tc.text {
+				t.Fatalf("unexpected response: %+v", out)
+			}
+		})
+	}
+}
+
+func TestEventsURLVerification(t *testing.T) {
+	t.Parallel()
+
+	bot := &Lorebot{Store: NewMemoryStore(), SigningSecret: "secret"}
+	body := `{"type":"url_verification","challenge":"abc123"}`
+	r := signedRequest("POST", "/slack/events", body, "secret")
+	w := httptest.NewRecorder()
+	bot.HTTPHandler().ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Body.String() != "abc123" {
+		t.Fatalf("expected challenge to be echoed, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSeenEvents(t *testing.T) {
+	t.Parallel()
+
+	var seen seenEvents
+	if seen.markSeen("Ev1") {
+		t.Fatalf("expected first delivery to be new")
+	}
+	if !seen.markSeen("Ev1") {
+		t.Fatalf("expected retry to be spotted")
+	}
+	if seen.markSeen("Ev2") {
+		t.Fatalf("expected a different event to be new")
+	}
+}
+
+func TestCommandRegistry(t *testing.T) {
+	t.Parallel()
+
+	registry := NewCommandRegistry()
+	registry.Register(&Command{
+		Name:    "echo",
+		Aliases: []string{"say"},
+		Args:    "<words>",
+		Help:    "repeat after me",
+		MinArgs: 1,
+		MaxArgs: 2,
+		Run: func(l *Lorebot, args []string) Reply {
+			return textReply(strings.Join(args, " "))
+		},
+	})
+
+	tt := []struct {
+		desc     string
+		name     string
+		args     []string
+		expected string
+	}{
+		{desc: "Name", name: "echo", args: []string{"hi"}, expected: "hi"},
+		{desc: "Alias", name: "SAY", args: []string{"hi", "there"}, expected: "hi there"},
+		{desc: "Too few", name: "echo", args: nil, expected: "Usage: `echo <words>`"},
+		{desc: "Too many", name: "echo", args: []string{"a", "b", "c"}, expected: "Usage: `echo <words>`"},
+		{desc: "Unknown", name: "shout", args: nil, expected: "Unknown command `shout`. Try `help`."},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			out := registry.Run(&Lorebot{}, tc.name, tc.args).Text
+
+			if out != tc.expected {
+				t.Fatalf("expected: '%v', got: '%v'", tc.expected, out)
+			}
+		})
+	}
+
+	if help := registry.Help(); !strings.Contains(help, "`echo <words>` - repeat after me") {
+		t.Fatalf("expected command in help, got: %s", help)
+	}
+	if help := registry.HelpFor("say"); !strings.Contains(help, "Also known as: say") {
+		t.Fatalf("expected aliases in command help, got: %s", help)
+	}
+}
+
+func TestMessageCommand(t *testing.T) {
+	t.Parallel()
+
+	bot := &Lorebot{LorebotID: "UBOT"}
+	tt := []struct {
+		desc     string
+		input    slack.Msg
+		expected []string
+	}{
+		{
+			desc:     "Mention in channel",
+			input:    slack.Msg{Channel: "C1", User: "U1", Text: "<@UBOT> random"},
+			expected: []string{"random"},
+		},
+		{
+			desc:  "Bare command in channel",
+			input: slack.Msg{Channel: "C1", User: "U1", Text: "random"},
+		},
+		{
+			desc:     "Command before a trailing mention",
+			input:    slack.Msg{Channel: "C1", User: "U1", Text: "top <@UBOT>"},
+			expected: []string{"top"},
+		},
+		{
+			desc:  "Thanking the bot",
+			input: slack.Msg{Channel: "C1", User: "U1", Text: "thanks <@UBOT>"},
+		},
+		{
+			desc:  "Mentioning the bot in passing",
+			input: slack.Msg{Channel: "C1", User: "U1", Text: "I think <@UBOT> is great"},
+		},
+		{
+			desc:     "Bare command in DM",
+			input:    slack.Msg{Channel: "D1", User: "U1", Text: "search pizza"},
+			expected: []string{"search", "pizza"},
+		},
+		{
+			desc:     "Mention in DM",
+			input:    slack.Msg{Channel: "D1", User: "U1", Text: "<@UBOT> top"},
+			expected: []string{"top"},
+		},
+		{
+			desc:  "Our own reply in DM",
+			input: slack.Msg{Channel: "D1", BotID: "B1", Text: "Unknown command"},
+		},
+		{
+			desc:  "Empty DM",
+			input: slack.Msg{Channel: "D1", User: "U1", Text: " "},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			ev := slack.MessageEvent{Msg: tc.input}
+			tokens, ok := bot.messageCommand(&ev)
+
+			if ok != (tc.expected != nil) {
+				t.Fatalf("expected a command: %v, got: %v", tc.expected != nil, ok)
+			}
+			if ok && !reflect.DeepEqual(tokenTexts(tokens), tc.expected) {
+				t.Fatalf("expected: '%v', got: '%v'", tc.expected, tokenTexts(tokens))
+			}
+		})
+	}
+}
+
+func TestReplyThread(t *testing.T) {
+	t.Parallel()
+
+	bot := &Lorebot{ReplyMode: "channel", CommandReplyModes: map[string]string{"search": "thread"}}
+	tt := []struct {
+		desc     string
+		input    slack.Msg
+		cmd      string
+		expected string
+	}{
+		{desc: "Channel mode", input: slack.Msg{Timestamp: "1.1"}, cmd: "random", expected: ""},
+		{desc: "Override", input: slack.Msg{Timestamp: "1.1"}, cmd: "search", expected: "1.1"},
+		{desc: "Override by alias", input: slack.Msg{Timestamp: "1.1"}, cmd: "find", expected: "1.1"},
+		{desc: "Already threaded", input: slack.Msg{Timestamp: "1.2", ThreadTimestamp: "1.1"}, cmd: "random", expected: "1.1"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.desc, func(t *testing.T) {
+			ev := slack.MessageEvent{Msg: tc.input}
+			out := bot.replyThread(&ev, tc.cmd)
+
+			if out != tc.expected {
+				t.Fatalf("expected: '%v', got: '%v'", tc.expected, out)
+			}
+		})
+	}
+}
+
+func TestLoresReply(t *testing.T) {
+	t.Parallel()
+
+	bot := &Lorebot{}
+	lores := []Lore{
+		{
+			userID:    "U1",
+			Message:   "line one\nline two",
+			Score:     3,
+			Permalink: "https://x.slack.com/p1",
+			Added:     time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{userID: "U2", Message: "legacy", Score: 1},
+	}
+	reply := bot.loresReply(lores, "More results")
+
+	if reply.Text != formatLores(lores)+"More results" {
+		t.Fatalf("expected plain text fallback, got: %s", reply.Text)
+	}
+	types := make([]string, len(reply.Blocks))
+	for i, block := range reply.Blocks {
+		types[i] = block.Type
+	}
+	expected := []string{"section", "context", "divider", "section", "context", "context"}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("expected blocks %v, got %v", expected, types)
+	}
+
+	first := reply.Blocks[0]
+	if first.Text.Text != "> line one\n> line two" {
+		t.Fatalf("expected multi-line quote, got: %q", first.Text.Text)
+	}
+	if first.Accessory == nil || first.Accessory.URL != "https://x.slack.com/p1" {
+		t.Fatalf("expected permalink button, got: %+v", first.Accessory)
+	}
+	meta := reply.Blocks[1].Elements[0].(*TextObject).Text
+	if meta != "<@U1> · :lore: 3 · <!date^1704153600^{date_short}|2024-01-02>" {
+		t.Fatalf("unexpected context: %s", meta)
+	}
+	if reply.Blocks[3].Accessory != nil {
+		t.Fatalf("expected no button without a permalink")
+	}
+}
+
+func TestInteractionVote(t *testing.T) {
+	t.Parallel()
+
+	responses := make(chan interactionResponse, 1)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp interactionResponse
+		json.NewDecoder(r.Body).Decode(&resp)
+		responses <- resp
+	}))
+	defer responder.Close()
+
+	store := NewMemoryStore()
+	store.InsertLore(Lore{userID: "U1", Message: "pizza is lore", ChannelID: "C1", MessageTS: "1.1"}, "U2")
+	bot := &Lorebot{Store: store}
+
+	// Blocks come back from Slack as JSON, not as our types
+	reply := bot.listLores(store.RecentLore(3, 0))
+	raw, _ := json.Marshal(map[string]interface{}{"text": reply.Text, "blocks": reply.Blocks})
+	var payload interactionPayload
+	if err := json.Unmarshal(raw, &payload.Message); err != nil {
+		t.Fatalf("failed to decode message: %v", err)
+	}
+	payload.Type = "block_actions"
+	payload.User.ID = "U3"
+	payload.ResponseURL = responder.URL
+	payload.Actions = append(payload.Actions, struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	}{ActionID: "upvote_lore", Value: "C1/1.1"})
+
+	bot.handleInteraction(payload)
+	resp := <-responses
+	if !resp.ReplaceOriginal || len(resp.Blocks) != len(reply.Blocks) {
+		t.Fatalf("expected message to be replaced, got: %+v", resp)
+	}
+	meta, _ := json.Marshal(resp.Blocks[1])
+	if !strings.Contains(string(meta), ":lore: 2") {
+		t.Fatalf("expected updated score, got: %s", meta)
+	}
+
+	bot.handleInteraction(payload)
+	resp = <-responses
+	if resp.ReplaceOriginal || resp.Text != "You've already voted for that lore." {
+		t.Fatalf("expected ephemeral note, got: %+v", resp)
+	}
+
+	bot.ZeroVotePolicy = "hide"
+	payload.Actions[0].ActionID = "retract_vote"
+	for _, voter := range []string{"U3", "U2"} {
+		payload.User.ID = voter
+		bot.handleInteraction(payload)
+		resp = <-responses
+	}
+	if len(resp.Blocks) != 0 {
+		t.Fatalf("expected hidden lore to be removed, got: %+v", resp.Blocks)
+	}
+}
+
+func TestPagedLores(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < pageSize+2; i++ {
+		store.InsertLore(Lore{
+			userID:    "U1",
+			Message:   "lore " + strconv.Itoa(i),
+			ChannelID: "C1",
+			MessageTS: strconv.Itoa(i) + ".1",
+		}, "U2")
+		store.lores[i].Added = start.Add(time.Duration(i) * time.Hour)
+	}
+	bot := &Lorebot{Store: store}
+
+	reply := bot.RunCommand("user", []string{"<@U1>"})
+	if strings.Count(reply.Text, "\n") != pageSize+1 || !strings.HasPrefix(reply.Text, "<@U1>: lore 11 ") {
+		t.Fatalf("expected the newest page, got: %s", reply.Text)
+	}
+	last := reply.Blocks[len(reply.Blocks)-1]
+	if last.Type != "actions" || last.Elements[0].(Element).Value != "user <@U1> page 2" {
+		t.Fatalf("expected a next page button, got: %+v", last)
+	}
+
+	reply = bot.RunCommand("user", []string{"<@U1>", "page", "2"})
+	if reply.Text != "<@U1>: lore 1 (1)\n<@U1>: lore 0 (1)\n" {
+		t.Fatalf("expected the last page, got: %s", reply.Text)
+	}
+	reply = bot.RunCommand("user", []string{"<@U1>", "page", "3"})
+	if reply.Text != "No more lore.\n" {
+		t.Fatalf("expected no more lore, got: %s", reply.Text)
+	}
+
+	for _, args := range [][]string{{"alice", "bob"}, {"page", "2"}} {
+		reply = bot.RunCommand("user", args)
+		if reply.Text != "Usage: `user <username> [page <n>]`" {
+			t.Fatalf("expected usage for user %v, got: %s", args, reply.Text)
+		}
+	}
+}
+
+func TestResultCount(t *testing.T) {
+	t.Parallel()
+
+	bot := &Lorebot{MaxResults: 5}
+	tt := []struct {
+		args  []string
+		count int
+		ok    bool
+	}{
+		{nil, 3, true},
+		{[]string{"4"}, 4, true},
+		{[]string{"50"}, 5, true},
+		{[]string{"0"}, 0, false},
+		{[]string{"pizza"}, 0, false},
+	}
+	for _, tc := range tt {
+		count, ok := bot.resultCount(tc.args, 3)
+		if count != tc.count || ok != tc.ok {
+			t.Fatalf("%v: expected %d %v, got %d %v", tc.args, tc.count, tc.ok, count, ok)
+		}
+	}
+
+	store := NewMemoryStore()
+	for i := 0; i < 4; i++ {
+		store.InsertLore(Lore{userID: "U1", Message: "lore", ChannelID: "C1", MessageTS: strconv.Itoa(i)}, "U2")
+	}
+	bot.Store = store
+	if reply := bot.RunCommand("top", []string{"2"}); strings.Count(reply.Text, "\n") != 3 || !strings.Contains(reply.Text, "`top 2 page 2`") {
+		t.Fatalf("expected two lores and a next page, got: %s", reply.Text)
+	}
+	if reply := bot.RunCommand("random", []string{"3"}); strings.Count(reply.Text, "\n") != 3 {
+		t.Fatalf("expected three random lores, got: %s", reply.Text)
+	}
+}
+
+func TestTimeWindows(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	args, window, since := parseWindow([]string{"month", "5"}, now)
+	if window != "month" || !since.Equal(time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)) || !reflect.DeepEqual(args, []string{"5"}) {
+		t.Fatalf("unexpected window %q since %v with %v", window, since, args)
+	}
+	if _, window, since = parseWindow([]string{"all"}, now); window != "" || !since.IsZero() {
+		t.Fatalf("expected all time, got %q since %v", window, since)
+	}
+
+	store := NewMemoryStore()
+	store.InsertLore(Lore{userID: "U1", Message: "old favourite", ChannelID: "C1", MessageTS: "1"}, "U9")
+	store.InsertLore(Lore{userID: "U2", Message: "new hotness", ChannelID: "C1", MessageTS: "2"}, "U9")
+	for _, voter := range []string{"U3", "U4"} {
+		store.UpvoteLore("C1", "1", voter)
+	}
+	// Backdate the old lore's votes
+	for voter := range store.lores[0].votes {
+		store.lores[0].votes[voter] = now.AddDate(0, -2, 0)
+	}
+
+	top, _ := store.TopLore(time.Time{}, 1, 0)
+	if top[0].Message != "old favourite" {
+		t.Fatalf("expected old favourite to be top of all time, got %s", top[0].Message)
+	}
+	top, _ = store.TopLore(now.AddDate(0, 0, -7), 5, 0)
+	if len(top) != 1 || top[0].Message != "new hotness" {
+		t.Fatalf("expected only new hotness this week, got %v", top)
+	}
+	highscores, _ := store.Highscores(now.AddDate(0, 0, -7), 5, 0)
+	if !reflect.DeepEqual(highscores, []Highscore{{UserID: "U2", Score: 1}}) {
+		t.Fatalf("unexpected weekly highscores: %v", highscores)
+	}
+}
+
+// Run with -race: windowed listings count votes while reactions add them
+func TestTimeWindowsWhileVoting(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore()
+	store.InsertLore(Lore{userID: "U1", Message: "popular", ChannelID: "C1", MessageTS: "1"}, "U9")
+	since := time.Now().AddDate(0, 0, -7)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			store.UpvoteLore("C1", "1", "V"+strconv.Itoa(i))
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		store.TopLore(since, 5, 0)
+		store.Highscores(since, 5, 0)
+	}
+	<-done
+
+	highscores, _ := store.Highscores(since, 5, 0)
+	if !reflect.DeepEqual(highscores, []Highscore{{UserID: "U1", Score: 101}}) {
+		t.Fatalf("unexpected weekly highscores: %v", highscores)
+	}
+}
+
+func TestCron(t *testing.T) {
+	t.Parallel()
+
+	from := time.Date(2024, 1, 1, 9, 30, 0, 0, time.UTC) // a Monday
+	tt := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 1, 9, 31, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2024, 1, 1, 9, 40, 0, 0, time.UTC)},
+		{"0 17 * * 5", time.Date(2024, 1, 5, 17, 0, 0, 0, time.UTC)},
+		{"0 10 * * 7", time.Date(2024, 1, 7, 10, 0, 0, 0, time.UTC)},
+		{"0 9 1,15 * *", time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are given
+		{"0 9 20 * 3", time.Date(2024, 1, 3, 9, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tc := range tt {
+		schedule, err := parseCron(tc.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.expr, err)
+		}
+		if next := schedule.next(from); !next.Equal(tc.next) {
+			t.Fatalf("%s: expected %v, got %v", tc.expr, tc.next, next)
+		}
+	}
+
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestScheduledJobs(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore()
+	at := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	if claimed, _ := store.ClaimScheduledRun("weekly_digest:C1", at); !claimed {
+		t.Fatalf("expected first claim to succeed")
+	}
+	if claimed, _ := store.ClaimScheduledRun("weekly_digest:C1", at); claimed {
+		t.Fatalf("expected a second claim of the same run to fail")
+	}
+	if claimed, _ := store.ClaimScheduledRun("weekly_digest:C1", at.AddDate(0, 0, 7)); !claimed {
+		t.Fatalf("expected the next run to be claimable")
+	}
+
+	if _, err := parseSchedules([]ScheduleConfig{{Job: "nope", Cron: "* * * * *", Channel: "C1"}}); err == nil {
+		t.Fatalf("expected unknown job to be rejected")
+	}
+
+	bot := &Lorebot{Store: store}
+	reply, err := weeklyDigest(bot, time.Now())
+	if err != nil || reply.Text != "" {
+		t.Fatalf("expected an empty digest with no lore, got %q %v", reply.Text, err)
+	}
+	store.InsertLore(Lore{userID: "U1", Message: "fresh", ChannelID: "C1", MessageTS: "1"}, "U2")
+	reply, _ = weeklyDigest(bot, time.Now())
+	expected := "*New lore this week*\n<@U1>: fresh (1)\n*Top lore this week*\n<@U1>: fresh (1)\n"
+	if reply.Text != expected || reply.Blocks[0].Type != "header" {
+		t.Fatalf("unexpected digest: %q", reply.Text)
+	}
+}
+
+func TestOnThisDay(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore()
+	for i, added := range []time.Time{
+		time.Date(2021, 6, 15, 10, 0, 0, 0, time.UTC),
+		time.Date(2022, 6, 15, 23, 0, 0, 0, time.UTC),
+		time.Date(2022, 6, 16, 9, 0, 0, 0, time.UTC),
+		time.Date(2024, 6, 15, 8, 0, 0, 0, time.UTC), // today
+	} {
+		store.InsertLore(Lore{userID: "U1", Message: "lore " + strconv.Itoa(i), ChannelID: "C1", MessageTS: strconv.Itoa(i)}, "U2")
+		store.lores[i].Added = added
+	}
+
+	day := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	lores, _ := store.LoreOnThisDay(day, 5, 0)
+	messages := make([]string, len(lores))
+	for i, lore := range lores {
+		messages[i] = lore.Message
+	}
+	if !reflect.DeepEqual(messages, []string{"lore 1", "lore 0"}) {
+		t.Fatalf("expected lore from earlier years, newest first, got %v", messages)
+	}
+
+	reply, _ := onThisDay(&Lorebot{Store: store}, day)
+	if !strings.HasPrefix(reply.Text, "*On this day*\n") {
+		t.Fatalf("unexpected post: %q", reply.Text)
+	}
+	if reply, _ = onThisDay(&Lorebot{Store: store}, day.AddDate(0, 0, 2)); reply.Text != "" {
+		t.Fatalf("expected nothing to post, got: %q", reply.Text)
+	}
+
+	if reply = (&Lorebot{Store: store}).RunCommand("onthisday", []string{"foo"}); reply.Text != "Usage: `onthisday [page <n>]`" {
+		t.Fatalf("expected usage, got: %s", reply.Text)
+	}
+}
+
+// Not parallel: it points the Web API at a fake Slack
+func TestFetchMessageFiles(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/conversations.history" {
+			t.Errorf("unexpected call to %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"ok": true, "messages": [{
+			"type": "message", "user": "U1", "text": "", "ts": "1.1",
+			"files": [
+				{"id": "F1", "name": "cat.png", "mimetype": "image/png", "permalink": "https://x.slack.com/files/cat.png"},
+				{"id": "F2", "name": "dog.gif", "mimetype": "image/gif", "permalink": "https://x.slack.com/files/dog.gif"}
+			]
+		}]}`))
+	}))
+	defer server.Close()
+	defer func(url string) { slackAPIURL = url }(slackAPIURL)
+	slackAPIURL = server.URL + "/"
+
+	bot := &Lorebot{Token: "xoxb-test"}
+	message, ok := bot.fetchMessage("C1", "1.1")
+	if !ok {
+		t.Fatalf("expected to find the message")
+	}
+	expected := []LoreAttachment{
+		{Kind: "file", Name: "cat.png", Permalink: "https://x.slack.com/files/cat.png", Mimetype: "image/png"},
+		{Kind: "file", Name: "dog.gif", Permalink: "https://x.slack.com/files/dog.gif", Mimetype: "image/gif"},
+	}
+	if attachments := messageAttachments(message); !reflect.DeepEqual(attachments, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, attachments)
+	}
+}
+
+// Not parallel: it points the Web API at a fake Slack
+func TestSocketMode(t *testing.T) {
+	conns := make(chan *websocket.Conn, 1)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apps.connections.open":
+			if r.Header.Get("Authorization") != "Bearer xapp-test" {
+				t.Errorf("expected the app token, got %q", r.Header.Get("Authorization"))
+			}
+			w.Write([]byte(`{"ok": true, "url": "ws` + strings.TrimPrefix(server.URL, "http") + `/socket"}`))
+		case "/socket":
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				t.Errorf("failed to upgrade: %v", err)
+				return
+			}
+			conns <- conn
+		}
+	}))
+	defer server.Close()
+	defer func(url string) { slackAPIURL = url }(slackAPIURL)
+	slackAPIURL = server.URL + "/"
+
+	store := NewMemoryStore()
+	store.InsertLore(Lore{userID: "U1", Message: "pizza is lore", ChannelID: "C1", MessageTS: "1.1"}, "U2")
+	bot := &Lorebot{Store: store, AppToken: "xapp-test"}
+	done := make(chan error, 1)
+	go func() { done <- bot.runSocket() }()
+
+	conn := <-conns
+	defer conn.Close()
+	reaction := func(eventID string, user string) string {
+		return `{"type": "event_callback", "event_id": "` + eventID + `", "event": {
+			"type": "reaction_added", "user": "` + user + `", "reaction": "lore",
+			"item": {"type": "message", "channel": "C1", "ts": "1.1"}}}`
+	}
+	envelopes := []string{
+		`{"type": "hello"}`,
+		`{"type": "events_api", "envelope_id": "E1", "payload": ` + reaction("Ev1", "U3") + `}`,
+		// A redelivery of Ev1; if it were handled U4's vote would count
+		`{"type": "events_api", "envelope_id": "E2", "payload": ` + reaction("Ev1", "U4") + `}`,
+		`{"type": "events_api", "envelope_id": "E3", "payload": ` + reaction("Ev2", "U5") + `}`,
+		`{"type": "slash_commands", "envelope_id": "E4", "payload": {"command": "/lore", "text": "help top"}}`,
+	}
+	for _, envelope := range envelopes {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(envelope)); err != nil {
+			t.Fatalf("failed to send envelope: %v", err)
+		}
+	}
+
+	// Each ack's payload, keyed by envelope
+	acks := make(map[string]*slashResponse)
+	for len(acks) < 4 {
+		var ack struct {
+			EnvelopeID string         `json:"envelope_id"`
+			Payload    *slashResponse `json:"payload"`
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.ReadJSON(&ack); err != nil {
+			t.Fatalf("expected acks for every envelope, got %v: %v", acks, err)
+		}
+		acks[ack.EnvelopeID] = ack.Payload
+	}
+	for _, id := range []string{"E1", "E2", "E3"} {
+		if acks[id] != nil {
+			t.Fatalf("expected an empty ack for %s, got %+v", id, acks[id])
+		}
+	}
+	if slash := acks["E4"]; slash == nil || slash.Text != commands.HelpFor("top") {
+		t.Fatalf("expected the slash command's reply in its ack, got %+v", slash)
+	}
+
+	// Events are handled after they're acked, in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lore, _ := store.GetLore("C1", "1.1")
+		if lore.Score == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected U3 and U5's votes to count, score is %d", lore.Score)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := store.UpvoteLore("C1", "1.1", "U4"); err != nil {
+		t.Fatalf("expected the redelivered event to be ignored, got: %v", err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "disconnect", "reason": "refresh_requested"}`))
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "refresh_requested") {
+			t.Fatalf("expected the connection to end on disconnect, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the connection to end on disconnect")
+	}
+}
+
+// Not parallel: it points the slack client at a fake Slack
+func TestAvatarCache(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		user := r.PostForm.Get("user")
+		mu.Lock()
+		calls[user]++
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+		if user == "U1" {
+			w.Write([]byte(`{"ok": true, "user": {"id": "U1", "profile": {"image_48": "https://x/u1.png"}}}`))
+		} else {
+			w.Write([]byte(`{"ok": false, "error": "user_not_found"}`))
+		}
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer server.Close()
+	defer func(url string) { slack.SLACK_API = url }(slack.SLACK_API)
+	slack.SLACK_API = server.URL + "/"
+
+	bot := &Lorebot{SlackAPI: slack.New("xoxb-test")}
+	lores := []Lore{{userID: "U1", Message: "a"}, {userID: "U2", Message: "b"}, {userID: "U1", Message: "c"}}
+	bot.loresReply(lores, "")
+	reply := bot.loresReply(lores, "")
+
+	if calls["U1"] != 1 || calls["U2"] != 1 {
+		t.Fatalf("expected one lookup per user, failures included, got %v", calls)
+	}
+	if maxInFlight < 2 {
+		t.Fatalf("expected lookups to run at the same time")
+	}
+	if avatar := reply.Blocks[1].Elements[0].(Element).ImageURL; avatar != "https://x/u1.png" {
+		t.Fatalf("expected cached avatar, got %q", avatar)
+	}
+}
+
+func TestHugePage(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore()
+	store.InsertLore(Lore{userID: "U1", Message: "pizza is lore", ChannelID: "C1", MessageTS: "1.1"}, "U2")
+	bot := &Lorebot{Store: store}
+	for _, cmd := range [][]string{
+		{"user", "U1", "page", "4611686018427387905"},
+		{"highscores", "page", "4611686018427387905"},
+		{"search", "pizza", "page", "9223372036854775807"},
+	} {
+		if reply := bot.RunCommand(cmd[0], cmd[1:]); !strings.HasPrefix(reply.Text, "No more lore") && reply.Text != "" {
+			t.Fatalf("%v: expected an empty page, got: %s", cmd, reply.Text)
+		}
+	}
+	if _, err := store.RecentLore(3, -1); err != ErrNegativeOffset {
+		t.Fatalf("expected a negative offset to be rejected, got: %v", err)
+	}
+}
+
+func TestLeapDayAnniversary(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemoryStore()
+	store.InsertLore(Lore{userID: "U1", Message: "leap", ChannelID: "C1", MessageTS: "1"}, "U2")
+	store.lores[0].Added = time.Date(2020, 2, 29, 12, 0, 0, 0, time.UTC)
+
+	tt := []struct {
+		day   time.Time
+		found bool
+	}{
+		{time.Date(2023, 2, 28, 9, 0, 0, 0, time.UTC), true},
+		{time.Date(2023, 3, 1, 9, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, 2, 28, 9, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, 2, 29, 9, 0, 0, 0, time.UTC), true},
+	}
+	for _, tc := range tt {
+		lores, _ := store.LoreOnThisDay(tc.day, 5, 0)
+		if (len(lores) == 1) != tc.found {
+			t.Fatalf("%s: expected found %v, got %v", tc.day.Format("2006-01-02"), tc.found, lores)
+		}
+	}
+}
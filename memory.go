@@ -0,0 +1,349 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryLore struct {
+	Lore
+	votes  map[string]time.Time // voter -> when they voted
+	hidden bool
+}
+
+// MemoryStore is an in-process LoreStore. Nothing is persisted across restarts.
+type MemoryStore struct {
+	mu    sync.Mutex
+	lores []memoryLore
+	runs  map[string]bool // job + scheduled time of claimed runs
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// snapshot returns a copy of the visible lores so callers can sort freely
+func (m *MemoryStore) snapshot() []memoryLore {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]memoryLore, 0, len(m.lores))
+	for _, s := range m.lores {
+		if !s.hidden {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// find returns the index of the matching lore, or -1. Callers must hold mu.
+func (m *MemoryStore) find(channelID string, messageTS string) int {
+	for i := range m.lores {
+		if m.lores[i].ChannelID == channelID && m.lores[i].MessageTS == messageTS {
+			return i
+		}
+	}
+	return -1
+}
+
+// toLores returns up to limit lores after skipping offset, or all of the
+// rest if limit is negative
+func toLores(stored []memoryLore, limit int, offset int) []Lore {
+	ret := make([]Lore, 0)
+	if offset >= len(stored) {
+		return ret
+	}
+	for _, s := range stored[offset:] {
+		if limit >= 0 && len(ret) >= limit {
+			break
+		}
+		ret = append(ret, s.Lore)
+	}
+	return ret
+}
+
+func (m *MemoryStore) RecentLore(limit int, offset int) ([]Lore, error) {
+	if err := checkOffset(offset); err != nil {
+		return nil, err
+	}
+	stored := m.snapshot()
+	sort.SliceStable(stored, func(i, j int) bool {
+		return stored[i].Added.After(stored[j].Added)
+	})
+	return toLores(stored, limit, offset), nil
+}
+
+func (m *MemoryStore) RandomLore(limit int) ([]Lore, error) {
+	stored := m.snapshot()
+	rand.Shuffle(len(stored), func(i, j int) {
+		stored[i], stored[j] = stored[j], stored[i]
+	})
+	return toLores(stored, limit, 0), nil
+}
+
+func (m *MemoryStore) TopLore(since time.Time, limit int, offset int) ([]Lore, error) {
+	if err := checkOffset(offset); err != nil {
+		return nil, err
+	}
+	if since.IsZero() {
+		stored := m.snapshot()
+		sort.SliceStable(stored, func(i, j int) bool {
+			return stored[i].Score > stored[j].Score
+		})
+		return toLores(stored, limit, offset), nil
+	}
+
+	ret, ranks := m.votedSince(since)
+	sort.Stable(byRank{ret, ranks})
+	return toLores(ret, limit, offset), nil
+}
+
+// votedSince returns the visible lores voted for at or after since, and how
+// many votes each got. The votes are counted under mu because snapshot
+// doesn't copy them.
+func (m *MemoryStore) votedSince(since time.Time) ([]memoryLore, []int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]memoryLore, 0)
+	votes := make([]int, 0)
+	for _, s := range m.lores {
+		if n := s.votesSince(since); n > 0 && !s.hidden {
+			ret = append(ret, s)
+			votes = append(votes, n)
+		}
+	}
+	return ret, votes
+}
+
+// votesSince counts the votes cast on a lore at or after since. Callers
+// must hold mu.
+func (s memoryLore) votesSince(since time.Time) int {
+	count := 0
+	for _, at := range s.votes {
+		if !at.Before(since) {
+			count++
+		}
+	}
+	return count
+}
+
+func (m *MemoryStore) LoreForUser(userID string, limit int, offset int) ([]Lore, error) {
+	if err := checkOffset(offset); err != nil {
+		return nil, err
+	}
+	ret := make([]memoryLore, 0)
+	for _, s := range m.snapshot() {
+		if s.userID == userID {
+			ret = append(ret, s)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Added.After(ret[j].Added)
+	})
+	return toLores(ret, limit, offset), nil
+}
+
+func (m *MemoryStore) LoreOnThisDay(day time.Time, limit int, offset int) ([]Lore, error) {
+	if err := checkOffset(offset); err != nil {
+		return nil, err
+	}
+	startOfDay := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	ret := make([]memoryLore, 0)
+	for _, s := range m.snapshot() {
+		added := s.Added.In(day.Location())
+		if added.Month() != day.Month() || !added.Before(startOfDay) {
+			continue
+		}
+		for _, d := range anniversaryDays(day) {
+			if added.Day() == d {
+				ret = append(ret, s)
+			}
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Added.After(ret[j].Added)
+	})
+	return toLores(ret, limit, offset), nil
+}
+
+func (m *MemoryStore) SearchLore(query string, limit int, offset int) ([]Lore, error) {
+	return m.SearchLoreFiltered(SearchFilter{Query: query}, limit, offset)
+}
+
+func (m *MemoryStore) SearchLoreFiltered(filter SearchFilter, limit int, offset int) ([]Lore, error) {
+	if err := checkOffset(offset); err != nil {
+		return nil, err
+	}
+	terms := parseSearchTerms(filter.Query)
+	ret := make([]memoryLore, 0)
+	ranks := make([]int, 0)
+	for _, s := range m.snapshot() {
+		if (filter.UserID != "" && s.userID != filter.UserID) ||
+			(filter.ChannelID != "" && s.ChannelID != filter.ChannelID) ||
+			(!filter.Since.IsZero() && s.Added.Before(filter.Since)) ||
+			(!filter.Before.IsZero() && !s.Added.Before(filter.Before)) ||
+			s.Score < filter.MinScore {
+			continue
+		}
+		rank := 1
+		if filter.Query != "" {
+			rank = terms.rank(s.Message)
+		}
+		if rank > 0 {
+			ret = append(ret, s)
+			ranks = append(ranks, rank)
+		}
+	}
+	sort.Stable(byRank{ret, ranks})
+	return toLores(ret, limit, offset), nil
+}
+
+// byRank orders search matches best first, breaking ties by score
+type byRank struct {
+	lores []memoryLore
+	ranks []int
+}
+
+func (b byRank) Len() int { return len(b.lores) }
+func (b byRank) Swap(i, j int) {
+	b.lores[i], b.lores[j] = b.lores[j], b.lores[i]
+	b.ranks[i], b.ranks[j] = b.ranks[j], b.ranks[i]
+}
+func (b byRank) Less(i, j int) bool {
+	if b.ranks[i] != b.ranks[j] {
+		return b.ranks[i] > b.ranks[j]
+	}
+	return b.lores[i].Score > b.lores[j].Score
+}
+
+func (m *MemoryStore) Highscores(since time.Time, limit int, offset int) ([]Highscore, error) {
+	if err := checkOffset(offset); err != nil {
+		return nil, err
+	}
+	scores := make(map[string]int)
+	if since.IsZero() {
+		for _, s := range m.snapshot() {
+			scores[s.userID] += s.Score
+		}
+	} else {
+		voted, votes := m.votedSince(since)
+		for i, s := range voted {
+			scores[s.userID] += votes[i]
+		}
+	}
+	ret := make([]Highscore, 0, len(scores))
+	for userID, score := range scores {
+		ret = append(ret, Highscore{UserID: userID, Score: score})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Score != ret[j].Score {
+			return ret[i].Score > ret[j].Score
+		}
+		return ret[i].UserID < ret[j].UserID
+	})
+	if offset >= len(ret) {
+		return []Highscore{}, nil
+	}
+	ret = ret[offset:]
+	if len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
+
+func (m *MemoryStore) UpvoteLore(channelID string, messageTS string, voterID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.find(channelID, messageTS)
+	if i < 0 {
+		return ErrNoLore
+	}
+	if _, ok := m.lores[i].votes[voterID]; ok {
+		return ErrAlreadyVoted
+	}
+	m.lores[i].votes[voterID] = time.Now()
+	m.lores[i].Score++
+	m.lores[i].hidden = false
+	return nil
+}
+
+func (m *MemoryStore) RetractVote(channelID string, messageTS string, voterID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.find(channelID, messageTS)
+	if i < 0 {
+		return 0, ErrNoVote
+	}
+	if _, ok := m.lores[i].votes[voterID]; !ok {
+		return 0, ErrNoVote
+	}
+	delete(m.lores[i].votes, voterID)
+	m.lores[i].Score--
+	return m.lores[i].Score, nil
+}
+
+func (m *MemoryStore) HideLore(channelID string, messageTS string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := m.find(channelID, messageTS); i >= 0 {
+		m.lores[i].hidden = true
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteLore(channelID string, messageTS string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := m.find(channelID, messageTS); i >= 0 {
+		m.lores = append(m.lores[:i], m.lores[i+1:]...)
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetLore(channelID string, messageTS string) (Lore, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.find(channelID, messageTS)
+	if i < 0 || m.lores[i].hidden {
+		return Lore{}, ErrNoLore
+	}
+	return m.lores[i].Lore, nil
+}
+
+func (m *MemoryStore) LoreExists(channelID string, messageTS string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.find(channelID, messageTS) >= 0, nil
+}
+
+func (m *MemoryStore) ClaimScheduledRun(job string, scheduledFor time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := job + " " + scheduledFor.UTC().Format(time.RFC3339)
+	if m.runs[key] {
+		return false, nil
+	}
+	if m.runs == nil {
+		m.runs = make(map[string]bool)
+	}
+	m.runs[key] = true
+	return true, nil
+}
+
+func (m *MemoryStore) InsertLore(lore Lore, addedBy string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.find(lore.ChannelID, lore.MessageTS) >= 0 {
+		return ErrLoreExists
+	}
+	now := time.Now()
+	lore.Score = 1
+	lore.AddedBy = addedBy
+	lore.Added = now
+	m.lores = append(m.lores, memoryLore{
+		Lore:  lore,
+		votes: map[string]time.Time{addedBy: now},
+	})
+	return nil
+}
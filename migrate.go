@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations live in sql/migrations as <version>_<name>.up.sql and
+// <version>_<name>.down.sql. They are compiled into the binary and applied
+// in version order; schema_migrations records which ones have run.
+//
+//go:embed sql/migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("sql/migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		filename := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(filename, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(filename, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file: %s", filename)
+		}
+
+		base := strings.TrimSuffix(filename, "."+direction+".sql")
+		spl := strings.SplitN(base, "_", 2)
+		if len(spl) != 2 {
+			return nil, fmt.Errorf("migration file %s is not named <version>_<name>", filename)
+		}
+		version, err := strconv.Atoi(spl[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration file %s has a bad version: %v", filename, err)
+		}
+
+		contents, err := migrationFiles.ReadFile(path.Join("sql/migrations", filename))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: spl[1]}
+			byVersion[version] = m
+		} else if m.Name != spl[1] {
+			return nil, fmt.Errorf("migration version %d is used by both %s and %s", version, m.Name, spl[1])
+		}
+		if direction == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	ret := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", m.Version, m.Name)
+		}
+		ret = append(ret, *m)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Version < ret[j].Version })
+	return ret, nil
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+	  version int primary key not null,
+	  name text not null,
+	  applied_at timestamp default current_timestamp
+	)`)
+	return err
+}
+
+// lockedVersion takes an exclusive lock on schema_migrations for the rest of
+// tx, so that two bots starting at once don't both run the same migration,
+// and reports whether version has already been applied.
+func lockedVersion(tx *sql.Tx, version int) (bool, error) {
+	if _, err := tx.Exec(`LOCK TABLE schema_migrations IN EXCLUSIVE MODE`); err != nil {
+		return false, err
+	}
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE version = $1`, version).Scan(&count)
+	return count > 0, err
+}
+
+// MigrateUp applies every migration that hasn't been applied yet, each in
+// its own transaction.
+func MigrateUp(db *sql.DB) error {
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		applied, err := lockedVersion(tx, m.Version)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if applied {
+			tx.Rollback()
+			continue
+		}
+
+		fmt.Printf("Applying migration %d_%s\n", m.Version, m.Name)
+		if _, err := tx.Exec(m.Up); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d_%s failed: %v", m.Version, m.Name, err)
+		}
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateDown reverts the most recently applied migrations, newest first.
+func MigrateDown(db *sql.DB, steps int) error {
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		applied, err := lockedVersion(tx, m.Version)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if !applied {
+			tx.Rollback()
+			continue
+		}
+		if m.Down == "" {
+			tx.Rollback()
+			return fmt.Errorf("migration %d_%s has no down script", m.Version, m.Name)
+		}
+
+		fmt.Printf("Reverting migration %d_%s\n", m.Version, m.Name)
+		if _, err := tx.Exec(m.Down); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("reverting migration %d_%s failed: %v", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = $1`, m.Version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		steps--
+	}
+	return nil
+}
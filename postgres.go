@@ -2,8 +2,10 @@ package main
 
 import "database/sql"
 import "fmt"
-import "log"
-import _ "github.com/lib/pq"
+import "strconv"
+import "strings"
+import "time"
+import "github.com/lib/pq"
 
 type PostgresClient struct {
 	Host     string
@@ -15,244 +17,555 @@ type PostgresClient struct {
 }
 
 type Lore struct {
-	userID  string
-	Message string
-	Score   int
+	loreID    int
+	userID    string
+	Message   string
+	Score     int
+	AddedBy   string // who first lore-reacted the message, empty for legacy lore
+	ChannelID string // channel + message timestamp identify the original message
+	MessageTS string
+	Permalink string
+	Added     time.Time
+	// Files and attachments on the original message, which may have no text
+	Attachments []LoreAttachment
 }
 
+type LoreAttachment struct {
+	Kind      string // "file" or "attachment"
+	Name      string
+	Permalink string
+	Mimetype  string
+	Text      string // attachment text, or its fallback
+}
+
+// loreColumns are the columns scanLores expects, in order. Legacy lore has
+// nulls for everything added after the original schema.
+const loreColumns = `lore_id, user_id, message, score, COALESCE(added_by, ''),
+	       COALESCE(channel_id, ''), COALESCE(message_ts, ''), COALESCE(permalink, ''),
+	       COALESCE(timestamp_added, 'epoch')`
+
 type Highscore struct {
 	UserID string
 	Score  int
 }
 
-func DB(c *Configuration) *sql.DB {
+func DB(c *Configuration) (*sql.DB, error) {
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
 		c.PGHost, c.PGPort, c.PGUser, c.PGPassword, c.PGDbname)
 	DB, err := sql.Open("postgres", psqlInfo)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	err = DB.Ping()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return DB
+	return DB, nil
 }
 
-func (p *PostgresClient) RecentLore() []Lore {
+func (p *PostgresClient) RecentLore(limit int, offset int) ([]Lore, error) {
+	defer observeQuery("RecentLore", time.Now())
+	if err := checkOffset(offset); err != nil {
+		return nil, err
+	}
 	sqlStatement := `
-	SELECT user_id, message, score
+	SELECT ` + loreColumns + `
 	  FROM lores
-	 ORDER BY timestamp_added DESC LIMIT 3`
-	rows, err := p.Query(sqlStatement)
+	 WHERE NOT hidden
+	 ORDER BY timestamp_added DESC, lore_id DESC
+	 LIMIT $1 OFFSET $2`
+	rows, err := p.Query(sqlStatement, limit, offset)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer rows.Close()
+	return p.withAttachments(scanLores(rows))
+}
 
-	ret := make([]Lore, 0)
+func (p *PostgresClient) RandomLore(limit int) ([]Lore, error) {
+	defer observeQuery("RandomLore", time.Now())
+	sqlStatement := `
+	SELECT ` + loreColumns + `
+	  FROM lores
+	 WHERE NOT hidden
+	 ORDER BY RANDOM() LIMIT $1`
+	rows, err := p.Query(sqlStatement, limit)
+	if err != nil {
+		return nil, err
+	}
+	return p.withAttachments(scanLores(rows))
+}
 
-	var l Lore
-	for rows.Next() {
-		if err := rows.Scan(&l.userID, &l.Message, &l.Score); err != nil {
-			log.Fatal(err)
-		}
-		ret = append(ret, l)
+func (p *PostgresClient) TopLore(since time.Time, limit int, offset int) ([]Lore, error) {
+	defer observeQuery("TopLore", time.Now())
+	if err := checkOffset(offset); err != nil {
+		return nil, err
+	}
+	sqlStatement := `
+	SELECT ` + loreColumns + `
+	  FROM lores
+	 WHERE NOT hidden
+	 ORDER BY score DESC, lore_id
+	 LIMIT $1 OFFSET $2`
+	args := []interface{}{limit, offset}
+	if !since.IsZero() {
+		// Rank by the votes cast in the window instead
+		sqlStatement = `
+	SELECT ` + loreColumns + `
+	  FROM lores
+	  JOIN (SELECT lore_id AS voted_lore_id, COUNT(*) AS recent_votes
+	          FROM votes
+	         WHERE timestamp_voted >= $3
+	         GROUP BY lore_id) recent ON recent.voted_lore_id = lores.lore_id
+	 WHERE NOT hidden
+	 ORDER BY recent_votes DESC, score DESC, lore_id
+	 LIMIT $1 OFFSET $2`
+		args = append(args, since)
+	}
+	rows, err := p.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	return p.withAttachments(scanLores(rows))
+}
 
+func (p *PostgresClient) LoreForUser(userID string, limit int, offset int) ([]Lore, error) {
+	defer observeQuery("LoreForUser", time.Now())
+	if err := checkOffset(offset); err != nil {
+		return nil, err
 	}
-	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+	sqlStatement := `
+	SELECT ` + loreColumns + `
+	  FROM lores
+	 WHERE user_id IN ($1) AND NOT hidden
+	 ORDER BY timestamp_added DESC, lore_id DESC
+	 LIMIT $2 OFFSET $3`
+	rows, err := p.Query(sqlStatement, userID, limit, offset)
+	if err != nil {
+		return nil, err
 	}
-	return ret
+	return p.withAttachments(scanLores(rows))
 }
 
-func (p *PostgresClient) RandomLore() []Lore {
+// LoreOnThisDay finds lore added on day's date in earlier years, newest
+// first. In years without a February 29th, that day's lore shows up on the
+// 28th.
+func (p *PostgresClient) LoreOnThisDay(day time.Time, limit int, offset int) ([]Lore, error) {
+	defer observeQuery("LoreOnThisDay", time.Now())
+	if err := checkOffset(offset); err != nil {
+		return nil, err
+	}
 	sqlStatement := `
-	SELECT user_id, message, score
+	SELECT ` + loreColumns + `
 	  FROM lores
-	 ORDER BY RANDOM() LIMIT 1`
-	rows, err := p.Query(sqlStatement)
+	 WHERE NOT hidden
+	   AND EXTRACT(MONTH FROM timestamp_added) = $1
+	   AND EXTRACT(DAY FROM timestamp_added) IN ($2, $3)
+	   AND timestamp_added < $4
+	 ORDER BY timestamp_added DESC, lore_id DESC
+	 LIMIT $5 OFFSET $6`
+	days := anniversaryDays(day)
+	// timestamp_added has no time zone, so compare against midnight as a
+	// wall clock time
+	startOfDay := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	rows, err := p.Query(sqlStatement, int(day.Month()), days[0], days[len(days)-1], startOfDay, limit, offset)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer rows.Close()
+	return p.withAttachments(scanLores(rows))
+}
 
-	ret := make([]Lore, 0)
+// SearchLore does a full text search over lore messages, best matches first.
+// The query supports "exact phrases" and -excluded words.
+func (p *PostgresClient) SearchLore(query string, limit int, offset int) ([]Lore, error) {
+	return p.SearchLoreFiltered(SearchFilter{Query: query}, limit, offset)
+}
 
-	var l Lore
-	for rows.Next() {
-		if err := rows.Scan(&l.userID, &l.Message, &l.Score); err != nil {
-			log.Fatal(err)
-		}
-		ret = append(ret, l)
+// SearchLoreFiltered is SearchLore narrowed by author, channel, date and
+// score. Without any free text the best scoring lore comes first.
+func (p *PostgresClient) SearchLoreFiltered(filter SearchFilter, limit int, offset int) ([]Lore, error) {
+	defer observeQuery("SearchLoreFiltered", time.Now())
+	if err := checkOffset(offset); err != nil {
+		return nil, err
+	}
+	args := []interface{}{filter.Query}
+	where := []string{"NOT hidden"}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
 
+	order := "score DESC, timestamp_added DESC, lore_id"
+	if filter.Query != "" {
+		where = append(where, "to_tsvector('english', message) @@ query")
+		order = "ts_rank(to_tsvector('english', message), query) DESC, score DESC, lore_id"
 	}
-	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+	if filter.UserID != "" {
+		where = append(where, "user_id = "+arg(filter.UserID))
+	}
+	if filter.ChannelID != "" {
+		where = append(where, "channel_id = "+arg(filter.ChannelID))
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "timestamp_added >= "+arg(filter.Since))
+	}
+	if !filter.Before.IsZero() {
+		where = append(where, "timestamp_added < "+arg(filter.Before))
 	}
-	return ret
+	if filter.MinScore != 0 {
+		where = append(where, "score >= "+arg(filter.MinScore))
+	}
+
+	sqlStatement := `
+	SELECT ` + loreColumns + `
+	  FROM lores, websearch_to_tsquery('english', $1) query
+	 WHERE ` + strings.Join(where, " AND ") + `
+	 ORDER BY ` + order + `
+	 LIMIT ` + arg(limit) + ` OFFSET ` + arg(offset)
+	rows, err := p.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	return p.withAttachments(scanLores(rows))
 }
 
-func (p *PostgresClient) TopLore() []Lore {
+func (p *PostgresClient) Highscores(since time.Time, limit int, offset int) ([]Highscore, error) {
+	defer observeQuery("Highscores", time.Now())
+	if err := checkOffset(offset); err != nil {
+		return nil, err
+	}
 	sqlStatement := `
-	SELECT user_id, message, score
+	SELECT user_id, SUM(score) AS highscore
 	  FROM lores
-	 ORDER BY score DESC LIMIT 3`
-	rows, err := p.Query(sqlStatement)
+	 WHERE NOT hidden
+      GROUP BY user_id
+      ORDER BY highscore DESC, user_id
+      LIMIT $1 OFFSET $2;
+	`
+	args := []interface{}{limit, offset}
+	if !since.IsZero() {
+		// Score each person by the votes their lore got in the window
+		sqlStatement = `
+	SELECT lores.user_id, COUNT(*) AS highscore
+	  FROM votes
+	  JOIN lores ON lores.lore_id = votes.lore_id
+	 WHERE NOT hidden AND timestamp_voted >= $3
+      GROUP BY lores.user_id
+      ORDER BY highscore DESC, lores.user_id
+      LIMIT $1 OFFSET $2;
+	`
+		args = append(args, since)
+	}
+	rows, err := p.Query(sqlStatement, args...)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer rows.Close()
 
-	ret := make([]Lore, 0)
+	ret := make([]Highscore, 0)
 
-	var l Lore
+	var h Highscore
 	for rows.Next() {
-		if err := rows.Scan(&l.userID, &l.Message, &l.Score); err != nil {
-			log.Fatal(err)
+		if err := rows.Scan(&h.UserID, &h.Score); err != nil {
+			return nil, err
 		}
-		ret = append(ret, l)
-
+		ret = append(ret, h)
 	}
 	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return ret
+	return ret, nil
 }
 
-func (p *PostgresClient) LoreForUser(userID string) []Lore {
-	sqlStatement := `
-	SELECT message, score
-	  FROM lores
-	 WHERE user_id IN ($1)`
-	rows, err := p.Query(sqlStatement, userID)
+// UpvoteLore records voterID's vote on a lore and bumps its score. Each
+// person gets one vote per lore; a repeat vote returns ErrAlreadyVoted.
+func (p *PostgresClient) UpvoteLore(channelID string, messageTS string, voterID string) error {
+	defer observeQuery("UpvoteLore", time.Now())
+	tx, err := p.Begin()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	ret := make([]Lore, 0)
-
-	var l Lore
-	for rows.Next() {
-		if err := rows.Scan(&l.Message, &l.Score); err != nil {
-			log.Fatal(err)
-		}
-		l.userID = userID
-		ret = append(ret, l)
+	loreID, err := loreIDFor(tx, channelID, messageTS)
+	if err == sql.ErrNoRows {
+		return ErrNoLore
+	}
+	if err != nil {
+		return err
+	}
 
+	res, err := tx.Exec(`
+	INSERT INTO votes (lore_id, user_id)
+	VALUES ($1, $2)
+	    ON CONFLICT (lore_id, user_id) DO NOTHING`, loreID, voterID)
+	if err != nil {
+		return err
 	}
-	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+	if inserted, err := res.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return ErrAlreadyVoted
 	}
-	return ret
+
+	_, err = tx.Exec(`
+    UPDATE lores
+       SET score = score + 1, hidden = false
+     WHERE lore_id = $1`, loreID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (p *PostgresClient) SearchLore(query string) []Lore {
-	sqlStatement := `
-	SELECT user_id, message, score
-	  FROM lores
-	 WHERE message ILIKE '%' || $1 || '%'`
-	rows, err := p.Query(sqlStatement, query)
+// RetractVote removes voterID's vote from a lore and returns the lore's
+// remaining score. Returns ErrNoVote if there was no vote to remove.
+func (p *PostgresClient) RetractVote(channelID string, messageTS string, voterID string) (int, error) {
+	defer observeQuery("RetractVote", time.Now())
+	tx, err := p.Begin()
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	ret := make([]Lore, 0)
+	loreID, err := loreIDFor(tx, channelID, messageTS)
+	if err == sql.ErrNoRows {
+		return 0, ErrNoVote
+	}
+	if err != nil {
+		return 0, err
+	}
 
-	var l Lore
-	for rows.Next() {
-		if err := rows.Scan(&l.userID, &l.Message, &l.Score); err != nil {
-			log.Fatal(err)
-		}
-		ret = append(ret, l)
+	res, err := tx.Exec(`
+	DELETE FROM votes
+	 WHERE lore_id = $1 AND user_id = $2`, loreID, voterID)
+	if err != nil {
+		return 0, err
+	}
+	if deleted, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if deleted == 0 {
+		return 0, ErrNoVote
+	}
 
+	var score int
+	err = tx.QueryRow(`
+    UPDATE lores
+       SET score = score - 1
+     WHERE lore_id = $1
+ RETURNING score`, loreID).Scan(&score)
+	if err != nil {
+		return 0, err
 	}
-	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+	return score, tx.Commit()
+}
+
+// ClaimScheduledRun relies on the primary key: only the first claim of a
+// run inserts a row.
+func (p *PostgresClient) ClaimScheduledRun(job string, scheduledFor time.Time) (bool, error) {
+	defer observeQuery("ClaimScheduledRun", time.Now())
+	sqlStatement := `
+	INSERT INTO scheduled_runs (job, scheduled_for)
+	VALUES ($1, $2)
+	    ON CONFLICT (job, scheduled_for) DO NOTHING`
+	res, err := p.Exec(sqlStatement, job, scheduledFor.UTC())
+	if err != nil {
+		return false, err
+	}
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
 	}
-	return ret
+	return claimed == 1, nil
 }
 
-func (p *PostgresClient) Highscores() []Highscore {
+// HideLore keeps a lore in the database but leaves it out of every listing
+// until someone votes for it again.
+func (p *PostgresClient) HideLore(channelID string, messageTS string) error {
+	defer observeQuery("HideLore", time.Now())
 	sqlStatement := `
-	SELECT user_id, SUM(score) AS highscore
+    UPDATE lores
+       SET hidden = true
+     WHERE channel_id = $1 AND message_ts = $2`
+	_, err := p.Exec(sqlStatement, channelID, messageTS)
+	return err
+}
+
+func (p *PostgresClient) DeleteLore(channelID string, messageTS string) error {
+	defer observeQuery("DeleteLore", time.Now())
+	sqlStatement := `
+	DELETE FROM lores
+	 WHERE channel_id = $1 AND message_ts = $2`
+	_, err := p.Exec(sqlStatement, channelID, messageTS)
+	return err
+}
+
+func (p *PostgresClient) LoreExists(channelID string, messageTS string) (bool, error) {
+	defer observeQuery("LoreExists", time.Now())
+	sqlStatement := `
+	SELECT COUNT(*)
 	  FROM lores
-      GROUP BY user_id
-      ORDER BY highscore DESC;
-	`
-	rows, err := p.Query(sqlStatement)
+	 WHERE channel_id = $1 AND message_ts = $2`
+	var count int
+	err := p.QueryRow(sqlStatement, channelID, messageTS).Scan(&count)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
-	defer rows.Close()
-
-	ret := make([]Highscore, 0)
+	return count > 0, nil
+}
 
-	var h Highscore
-	for rows.Next() {
-		if err := rows.Scan(&h.UserID, &h.Score); err != nil {
-			log.Fatal(err)
-		}
-		ret = append(ret, h)
+func (p *PostgresClient) GetLore(channelID string, messageTS string) (Lore, error) {
+	defer observeQuery("GetLore", time.Now())
+	sqlStatement := `
+	SELECT ` + loreColumns + `
+	  FROM lores
+	 WHERE NOT hidden AND channel_id = $1 AND message_ts = $2`
+	rows, err := p.Query(sqlStatement, channelID, messageTS)
+	if err != nil {
+		return Lore{}, err
 	}
-	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+	lores, err := p.withAttachments(scanLores(rows))
+	if err != nil {
+		return Lore{}, err
 	}
-	return ret
+	if len(lores) == 0 {
+		return Lore{}, ErrNoLore
+	}
+	return lores[0], nil
 }
 
-func (p *PostgresClient) UpvoteLore(userID string, message string) {
-	sqlStatement := `
-    UPDATE lores
-       SET score = score + 1
-     WHERE message IN ($1) and user_id in ($2)`
-	_, err := p.Query(sqlStatement, message, userID)
+// InsertLore adds a new lore, counting the person who added it as its
+// first vote.
+func (p *PostgresClient) InsertLore(lore Lore, addedBy string) error {
+	defer observeQuery("InsertLore", time.Now())
+	tx, err := p.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Two reactions at once can both try to add the same message
+	var loreID int
+	err = tx.QueryRow(`
+	INSERT INTO lores (user_id, message, score, added_by, channel_id, message_ts, permalink)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	    ON CONFLICT (channel_id, message_ts) DO NOTHING
+	RETURNING lore_id`,
+		lore.userID, lore.Message, 1, addedBy, lore.ChannelID, lore.MessageTS, lore.Permalink).Scan(&loreID)
+	if err == sql.ErrNoRows {
+		return ErrLoreExists
+	}
 	if err != nil {
-		panic(err)
+		return err
 	}
+
+	_, err = tx.Exec(`
+	INSERT INTO votes (lore_id, user_id)
+	VALUES ($1, $2)`, loreID, addedBy)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range lore.Attachments {
+		_, err = tx.Exec(`
+		INSERT INTO lore_attachments (lore_id, kind, name, permalink, mimetype, text)
+		VALUES ($1, $2, $3, $4, $5, $6)`, loreID, a.Kind, a.Name, a.Permalink, a.Mimetype, a.Text)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (p *PostgresClient) LoreExists(message string, user_id string) bool {
-	sqlStatement := `
-	SELECT COUNT(*)
+func loreIDFor(tx *sql.Tx, channelID string, messageTS string) (int, error) {
+	var loreID int
+	err := tx.QueryRow(`
+	SELECT lore_id
 	  FROM lores
-	 WHERE message IN ($1) and user_id in ($2)`
-	rows, err := p.Query(sqlStatement, message, user_id)
+	 WHERE channel_id = $1 AND message_ts = $2`, channelID, messageTS).Scan(&loreID)
+	return loreID, err
+}
+
+// withAttachments fills in the attachments for lores fetched by one of the
+// listing queries. It takes scanLores' results directly so callers can chain.
+func (p *PostgresClient) withAttachments(lores []Lore, err error) ([]Lore, error) {
+	if err != nil || len(lores) == 0 {
+		return lores, err
+	}
+	defer observeQuery("withAttachments", time.Now())
+
+	ids := make([]int64, len(lores))
+	byID := make(map[int]*Lore, len(lores))
+	for i := range lores {
+		ids[i] = int64(lores[i].loreID)
+		byID[lores[i].loreID] = &lores[i]
+	}
+
+	rows, err := p.Query(`
+	SELECT lore_id, kind, name, permalink, mimetype, text
+	  FROM lore_attachments
+	 WHERE lore_id = ANY($1)
+	 ORDER BY attachment_id`, pq.Array(ids))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer rows.Close()
 
-	rows.Next()
-	var count int
-	if err := rows.Scan(&count); err != nil {
-		panic(err)
+	for rows.Next() {
+		var loreID int
+		var a LoreAttachment
+		if err := rows.Scan(&loreID, &a.Kind, &a.Name, &a.Permalink, &a.Mimetype, &a.Text); err != nil {
+			return nil, err
+		}
+		if l, ok := byID[loreID]; ok {
+			l.Attachments = append(l.Attachments, a)
+		}
 	}
-	return count > 0
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return lores, nil
 }
 
-func (p *PostgresClient) InsertLore(user_id string, content string) {
-	sqlStatement := `
-	INSERT INTO lores (user_id, message, score)
-	VALUES ($1, $2, $3)`
-	_, err := p.Exec(sqlStatement, user_id, content, 1)
-	if err != nil {
-		panic(err)
+// scanLores reads loreColumns rows and closes them
+func scanLores(rows *sql.Rows) ([]Lore, error) {
+	defer rows.Close()
+
+	ret := make([]Lore, 0)
+
+	var l Lore
+	for rows.Next() {
+		if err := rows.Scan(&l.loreID, &l.userID, &l.Message, &l.Score, &l.AddedBy,
+			&l.ChannelID, &l.MessageTS, &l.Permalink, &l.Added); err != nil {
+			return nil, err
+		}
+		ret = append(ret, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
+	return ret, nil
 }
 
-func NewPostgresClient(c *Configuration) *PostgresClient {
+// NewPostgresClient connects to Postgres and brings the schema up to date
+// before returning.
+func NewPostgresClient(c *Configuration) (*PostgresClient, error) {
+	db, err := DB(c)
+	if err != nil {
+		return nil, err
+	}
 	client := PostgresClient{
 		Host:     c.PGHost,
 		Port:     c.PGPort,
 		User:     c.PGUser,
 		Password: c.PGPassword,
 		Dbname:   c.PGDbname,
-		DB:       DB(c),
+		DB:       db,
 	}
 	client.DB.SetMaxOpenConns(50)
 
-	return &client
+	if err := MigrateUp(client.DB); err != nil {
+		return nil, fmt.Errorf("failed to migrate schema: %v", err)
+	}
+
+	return &client, nil
 }
@@ -1 +1,171 @@
 package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small hand-rolled Prometheus exporter. We only need counters and
+// histograms, so this writes the text exposition format directly rather
+// than pulling in the full client library.
+// See: https://prometheus.io/docs/instrumenting/exposition_formats/
+
+var (
+	loresAdded = newCounterVec("lorebot_lores_added_total",
+		"Number of lores added.", "")
+	upvotes = newCounterVec("lorebot_upvotes_total",
+		"Number of upvotes recorded on existing lore.", "")
+	retractions = newCounterVec("lorebot_vote_retractions_total",
+		"Number of votes retracted, by removing a :lore: reaction or with the Remove vote button.", "")
+	commandsHandled = newCounterVec("lorebot_commands_total",
+		"Number of commands handled, by command name.", "command")
+	slackAPIErrors = newCounterVec("lorebot_slack_api_errors_total",
+		"Number of failed Slack API calls, by method.", "method")
+	rtmReconnects = newCounterVec("lorebot_rtm_reconnects_total",
+		"Number of times the RTM connection was re-established.", "")
+	socketReconnects = newCounterVec("lorebot_socket_mode_reconnects_total",
+		"Number of times the Socket Mode connection was re-established.", "")
+	scheduledRuns = newCounterVec("lorebot_scheduled_runs_total",
+		"Number of scheduled jobs run, by job.", "job")
+	queryDuration = newHistogramVec("lorebot_postgres_query_duration_seconds",
+		"Latency of Postgres queries, by PostgresClient method.", "method",
+		[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5})
+
+	metrics = []collector{loresAdded, upvotes, retractions, commandsHandled, slackAPIErrors, rtmReconnects, socketReconnects, scheduledRuns, queryDuration}
+)
+
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+// counterVec is a monotonically increasing counter, optionally split by a
+// single label. An empty label name means the counter is unlabelled.
+type counterVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Inc(labelValue string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelValue]++
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %v\n", c.name, c.values[""])
+		return
+	}
+	for _, lv := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s=%q} %v\n", c.name, c.label, lv, c.values[lv])
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram split by a single label
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(labelValue string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[labelValue]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[labelValue] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labels := make([]string, 0, len(h.values))
+	for lv := range h.values {
+		labels = append(labels, lv)
+	}
+	sort.Strings(labels)
+	for _, lv := range labels {
+		hist := h.values[lv]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"%v\"} %d\n", h.name, h.label, lv, bound, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", h.name, h.label, lv, hist.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %v\n", h.name, h.label, lv, hist.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", h.name, h.label, lv, hist.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// observeQuery records how long a PostgresClient method took. Use it as
+// `defer observeQuery("RecentLore", time.Now())`.
+func observeQuery(method string, start time.Time) {
+	queryDuration.Observe(method, time.Since(start).Seconds())
+}
+
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	var sb strings.Builder
+	for _, m := range metrics {
+		m.writeTo(&sb)
+	}
+	io.WriteString(w, sb.String())
+}
+
+// ServeMetrics exposes /metrics on addr. It blocks, so run it in a goroutine.
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", MetricsHandler)
+	fmt.Println("Serving metrics on " + addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Printf("metrics server stopped: %v\n", err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Scheduled jobs post to a channel on a cron schedule. Each run is claimed
+// in the store before it posts, so a run is never posted twice, even across
+// restarts.
+
+// A run missed by less than this, e.g. because the bot was restarting at
+// the time, still happens when the bot comes back
+const scheduleCatchUp = time.Hour
+
+// How many lores each section of a scheduled post shows
+const digestSize = 5
+
+type scheduledJob struct {
+	Job      string
+	Channel  string
+	schedule *cronSchedule
+}
+
+// scheduledJobs are the jobs a schedule can run. Each returns what to post
+// for the run scheduled at, or an empty reply to post nothing.
+var scheduledJobs = map[string]func(l *Lorebot, at time.Time) (Reply, error){
+	"lore_of_the_day": loreOfTheDay,
+	"weekly_digest":   weeklyDigest,
+	"on_this_day":     onThisDay,
+}
+
+func parseSchedules(confs []ScheduleConfig) ([]scheduledJob, error) {
+	jobs := make([]scheduledJob, 0, len(confs))
+	for _, conf := range confs {
+		if _, ok := scheduledJobs[conf.Job]; !ok {
+			return nil, fmt.Errorf("unknown scheduled job: %s", conf.Job)
+		}
+		if conf.Channel == "" {
+			return nil, fmt.Errorf("scheduled job %s needs a Channel", conf.Job)
+		}
+		schedule, err := parseCron(conf.Cron)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, scheduledJob{Job: conf.Job, Channel: conf.Channel, schedule: schedule})
+	}
+	return jobs, nil
+}
+
+func (l *Lorebot) startScheduler() {
+	for _, job := range l.Schedules {
+		go l.runSchedule(job)
+	}
+}
+
+// runSchedule runs job every time its schedule fires, starting with the
+// latest run missed within scheduleCatchUp. It never returns.
+func (l *Lorebot) runSchedule(job scheduledJob) {
+	now := time.Now()
+	at := job.schedule.next(now.Add(-scheduleCatchUp))
+	for next := job.schedule.next(at); !at.IsZero() && !next.After(now); next = job.schedule.next(at) {
+		at = next
+	}
+	for !at.IsZero() {
+		time.Sleep(time.Until(at))
+		l.runScheduledJob(job, at)
+		at = job.schedule.next(at)
+	}
+	fmt.Printf("Scheduled job %s will never run again\n", job.Job)
+}
+
+// runScheduledJob does the run of job scheduled at, unless it's been done
+func (l *Lorebot) runScheduledJob(job scheduledJob, at time.Time) {
+	// The same job may post to several channels
+	claimed, err := l.Store.ClaimScheduledRun(job.Job+":"+job.Channel, at)
+	if err != nil {
+		fmt.Printf("failed to claim %s run: %v\n", job.Job, err)
+		return
+	}
+	if !claimed {
+		fmt.Printf("Skipping %s run for %s, it already happened\n", job.Job, at)
+		return
+	}
+
+	reply, err := scheduledJobs[job.Job](l, at)
+	if err != nil {
+		fmt.Printf("scheduled job %s failed: %v\n", job.Job, err)
+		return
+	}
+	scheduledRuns.Inc(job.Job)
+	if reply.Text == "" {
+		return
+	}
+	l.SendMessage(Message{ChannelID: job.Channel, Content: reply.Text, Blocks: reply.Blocks})
+}
+
+func loreOfTheDay(l *Lorebot, at time.Time) (Reply, error) {
+	lores, err := l.Store.RandomLore(1)
+	if err != nil || len(lores) == 0 {
+		return Reply{}, err
+	}
+	var digest digestReply
+	digest.add(l, "Lore of the day", lores)
+	return digest.Reply(), nil
+}
+
+// onThisDay shows lore added on the same date in earlier years, and posts
+// nothing if there isn't any
+func onThisDay(l *Lorebot, at time.Time) (Reply, error) {
+	lores, err := l.Store.LoreOnThisDay(at, digestSize, 0)
+	if err != nil || len(lores) == 0 {
+		return Reply{}, err
+	}
+	var digest digestReply
+	digest.add(l, "On this day", lores)
+	return digest.Reply(), nil
+}
+
+// weeklyDigest shows the lore added in the week up to at, and the lore
+// most voted for that week
+func weeklyDigest(l *Lorebot, at time.Time) (Reply, error) {
+	since := at.AddDate(0, 0, -7)
+	recent, err := l.Store.RecentLore(digestSize, 0)
+	if err != nil {
+		return Reply{}, err
+	}
+	for i, lore := range recent {
+		if lore.Added.Before(since) {
+			recent = recent[:i]
+			break
+		}
+	}
+	top, err := l.Store.TopLore(since, digestSize, 0)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	var digest digestReply
+	digest.add(l, "New lore this week", recent)
+	digest.add(l, "Top lore this week", top)
+	return digest.Reply(), nil
+}
+
+// digestReply builds a reply out of headed lists of lore
+type digestReply struct {
+	reply    Reply
+	textOnly bool
+}
+
+func (d *digestReply) add(l *Lorebot, heading string, lores []Lore) {
+	if len(lores) == 0 {
+		return
+	}
+	section := l.loresReply(lores, "")
+	d.reply.Text += "*" + heading + "*\n" + section.Text
+	d.reply.Blocks = append(d.reply.Blocks, Block{Type: "header", Text: plainText(heading)})
+	d.reply.Blocks = append(d.reply.Blocks, section.Blocks...)
+	d.textOnly = d.textOnly || len(section.Blocks) == 0
+}
+
+func (d *digestReply) Reply() Reply {
+	if d.textOnly || len(d.reply.Blocks) > maxBlocks {
+		return Reply{Text: d.reply.Text}
+	}
+	return d.reply
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// How many lores a page of search results shows
+const searchPageSize = 5
+
+// searchTerms is a parsed search query. The syntax matches Postgres'
+// websearch_to_tsquery: bare words must all appear, "quoted phrases" must
+// appear as written and -words must not appear.
+type searchTerms struct {
+	Words    []string
+	Phrases  []string
+	Excluded []string
+}
+
+func parseSearchTerms(query string) searchTerms {
+	var terms searchTerms
+	// Slack clients like to turn straight quotes into curly ones
+	query = strings.NewReplacer("“", `"`, "”", `"`).Replace(strings.ToLower(query))
+
+	for query != "" {
+		query = strings.TrimLeft(query, " \t\n")
+		switch {
+		case query == "":
+		case query[0] == '"':
+			// An unterminated quote runs to the end of the query
+			phrase, rest := query[1:], ""
+			if end := strings.IndexByte(phrase, '"'); end >= 0 {
+				phrase, rest = phrase[:end], phrase[end+1:]
+			}
+			if phrase = strings.Join(strings.Fields(phrase), " "); phrase != "" {
+				terms.Phrases = append(terms.Phrases, phrase)
+			}
+			query = rest
+		default:
+			end := strings.IndexAny(query, " \t\n")
+			if end < 0 {
+				end = len(query)
+			}
+			word := query[:end]
+			query = query[end:]
+			if strings.HasPrefix(word, "-") && len(word) > 1 {
+				terms.Excluded = append(terms.Excluded, word[1:])
+			} else if word != "-" {
+				terms.Words = append(terms.Words, word)
+			}
+		}
+	}
+	return terms
+}
+
+// rank scores how well text matches, with zero meaning no match. This is the
+// in-memory stand-in for ts_rank, without the stemming.
+func (t searchTerms) rank(text string) int {
+	text = strings.ToLower(text)
+	for _, excluded := range t.Excluded {
+		if strings.Contains(text, excluded) {
+			return 0
+		}
+	}
+	rank := 0
+	for _, needle := range append(append([]string{}, t.Words...), t.Phrases...) {
+		count := strings.Count(text, needle)
+		if count == 0 {
+			return 0
+		}
+		rank += count
+	}
+	return rank
+}
+
+// parseSearchPage splits a trailing "page N" off the search arguments,
+// unless that would leave nothing to search for
+func parseSearchPage(args []string) ([]string, int) {
+	rest, page := parsePage(args)
+	if len(rest) == 0 {
+		return args, 1
+	}
+	return rest, page
+}
+
+// SearchFilter is a parsed search command, e.g.
+// `search pizza from:@alice in:#general after:2024-01-01 score:>3`
+type SearchFilter struct {
+	Query     string    // free text, see searchTerms
+	UserID    string    // from:
+	ChannelID string    // in:
+	Since     time.Time // lore added at or after this time, zero for any
+	Before    time.Time // lore added strictly before this time, zero for any
+	MinScore  int       // 0 for any
+
+	// Plain from:@name and in:#name filters that Slack didn't turn into
+	// mentions. The bot resolves these to UserID and ChannelID.
+	UserName    string
+	ChannelName string
+}
+
+const searchDateFormat = "2006-01-02"
+
+func (f SearchFilter) IsFiltered() bool {
+	return f.UserID != "" || f.ChannelID != "" || f.UserName != "" || f.ChannelName != "" ||
+		!f.Since.IsZero() || !f.Before.IsZero() || f.MinScore != 0
+}
+
+// parseSearchFilter pulls the key:value filters out of the search arguments,
+// leaving the rest as free text.
+func parseSearchFilter(args []string) (SearchFilter, error) {
+	var filter SearchFilter
+	words := make([]string, 0, len(args))
+	for _, arg := range args {
+		spl := strings.SplitN(arg, ":", 2)
+		if len(spl) != 2 || spl[1] == "" {
+			words = append(words, arg)
+			continue
+		}
+		key, value := strings.ToLower(spl[0]), spl[1]
+		switch key {
+		case "from":
+			id, name := parseEntity(value, "@")
+			filter.UserID, filter.UserName = id, name
+		case "in":
+			id, name := parseEntity(value, "#")
+			filter.ChannelID, filter.ChannelName = id, name
+		case "after":
+			day, err := time.Parse(searchDateFormat, value)
+			if err != nil {
+				return filter, fmt.Errorf("after: wants a date like 2024-01-31, got %s", value)
+			}
+			filter.Since = day.AddDate(0, 0, 1)
+		case "before":
+			day, err := time.Parse(searchDateFormat, value)
+			if err != nil {
+				return filter, fmt.Errorf("before: wants a date like 2024-01-31, got %s", value)
+			}
+			filter.Before = day
+		case "score":
+			score, err := parseMinScore(value)
+			if err != nil {
+				return filter, err
+			}
+			filter.MinScore = score
+		default:
+			// Not a filter, just text with a colon in it
+			words = append(words, arg)
+		}
+	}
+	filter.Query = joinArgs(words)
+	return filter, nil
+}
+
+// joinArgs puts tokenized arguments back together, re-quoting any that were
+// quoted phrases so the search syntax still sees them
+func joinArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if strings.IndexFunc(arg, unicode.IsSpace) >= 0 {
+			arg = `"` + arg + `"`
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+// parseEntity reads a from: or in: value, which is either Slack's
+// <@U123|name> / <#C123|name> markup or a bare name.
+func parseEntity(value string, sigil string) (id string, name string) {
+	if strings.HasPrefix(value, "<"+sigil) && strings.HasSuffix(value, ">") {
+		id = strings.TrimSuffix(strings.TrimPrefix(value, "<"+sigil), ">")
+		if bar := strings.IndexByte(id, '|'); bar >= 0 {
+			id = id[:bar]
+		}
+		return id, ""
+	}
+	return "", strings.TrimPrefix(value, sigil)
+}
+
+func parseMinScore(value string) (int, error) {
+	offset := 0
+	switch {
+	case strings.HasPrefix(value, ">="):
+		value = value[2:]
+	case strings.HasPrefix(value, ">"):
+		value = value[1:]
+		offset = 1
+	}
+	score, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("score: wants a minimum like >3, got %s", value)
+	}
+	return score + offset, nil
+}
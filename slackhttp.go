@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Requests older than this are rejected, to stop replays
+const maxRequestAge = 5 * time.Minute
+
+// verifySlackRequest checks the request was signed by Slack with our signing
+// secret and returns its body. The body is also put back on the request so
+// that handlers can still call ParseForm.
+// See: https://api.slack.com/authentication/verifying-requests-from-slack
+func verifySlackRequest(r *http.Request, signingSecret string) ([]byte, error) {
+	if signingSecret == "" {
+		return nil, errors.New("no signing secret configured")
+	}
+
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("missing request timestamp")
+	}
+	if math.Abs(float64(time.Now().Unix()-sent)) > maxRequestAge.Seconds() {
+		return nil, errors.New("request timestamp too old")
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature"))) {
+		return nil, errors.New("bad signature")
+	}
+	return body, nil
+}
+
+type slashResponse struct {
+	ResponseType string  `json:"response_type"` // "ephemeral" or "in_channel"
+	Text         string  `json:"text"`
+	Blocks       []Block `json:"blocks,omitempty"`
+}
+
+// HandleSlashCommand answers `/lore <command>`. Replies are only shown to
+// the person who asked unless SlashInChannel is set, or the command starts
+// with "share", e.g. `/lore share random`.
+// See: https://api.slack.com/interactivity/slash-commands
+func (l *Lorebot) HandleSlashCommand(w http.ResponseWriter, r *http.Request) {
+	if _, err := verifySlackRequest(r, l.SigningSecret); err != nil {
+		fmt.Printf("rejected slash command: %v\n", err)
+		http.Error(w, "invalid request", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.slashCommand(r.PostForm.Get("command"), r.PostForm.Get("text")))
+}
+
+// slashCommand runs the command in a slash command's text
+func (l *Lorebot) slashCommand(command string, text string) slashResponse {
+	responseType := "ephemeral"
+	if l.SlashInChannel {
+		responseType = "in_channel"
+	}
+	spl := tokenTexts(tokenize(text))
+	if len(spl) > 0 && spl[0] == "share" {
+		responseType = "in_channel"
+		spl = spl[1:]
+	}
+	if len(spl) == 0 {
+		spl = []string{"help"}
+	}
+
+	reply := l.RunCommand(spl[0], spl[1:])
+	if reply.Text == "" {
+		reply = textReply("Nothing to show. Try `" + command + " help`.")
+	}
+	return slashResponse{ResponseType: responseType, Text: reply.Text, Blocks: reply.Blocks}
+}
+
+// HTTPHandler routes the endpoints Slack calls us on
+func (l *Lorebot) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slack/commands", l.HandleSlashCommand)
+	mux.HandleFunc("/slack/events", l.HandleEvents)
+	mux.HandleFunc("/slack/interactive", l.HandleInteraction)
+	return mux
+}
+
+// ServeSlack listens for Slack's requests on addr. It blocks, so run it in a
+// goroutine.
+func (l *Lorebot) ServeSlack(addr string) {
+	fmt.Println("Serving Slack endpoints on " + addr)
+	if err := http.ListenAndServe(addr, l.HTTPHandler()); err != nil {
+		fmt.Printf("slack http server stopped: %v\n", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Socket Mode support. The bot opens a websocket to Slack and events come
+// down it, so nothing needs to be exposed to the internet.
+// See: https://api.slack.com/apis/connections/socket
+
+const (
+	socketMinBackoff = time.Second
+	socketMaxBackoff = 2 * time.Minute
+)
+
+type socketEnvelope struct {
+	Type       string          `json:"type"`
+	EnvelopeID string          `json:"envelope_id"`
+	Payload    json.RawMessage `json:"payload"`
+	Reason     string          `json:"reason"` // disconnect
+}
+
+type socketAck struct {
+	EnvelopeID string      `json:"envelope_id"`
+	Payload    interface{} `json:"payload,omitempty"`
+}
+
+type socketSlashPayload struct {
+	Command string `json:"command"`
+	Text    string `json:"text"`
+}
+
+// socketConn serialises writes, since acks are sent from handler goroutines
+type socketConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *socketConn) ack(envelopeID string, payload interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.WriteJSON(socketAck{EnvelopeID: envelopeID, Payload: payload})
+}
+
+// openSocketURL asks Slack for a fresh websocket URL. Each URL is single use.
+// See: https://api.slack.com/methods/apps.connections.open
+func (l *Lorebot) openSocketURL() (string, error) {
+	var resp struct {
+		URL string `json:"url"`
+	}
+	if err := callWebAPI(l.AppToken, "apps.connections.open", url.Values{}, &resp); err != nil {
+		return "", err
+	}
+	return resp.URL, nil
+}
+
+// startSocketMode keeps a Socket Mode connection open, reconnecting with
+// backoff whenever it drops or Slack asks us to. It blocks.
+func (l *Lorebot) startSocketMode() {
+	backoff := socketMinBackoff
+	for connections := 0; ; connections++ {
+		if connections > 0 {
+			socketReconnects.Inc("")
+		}
+
+		start := time.Now()
+		err := l.runSocket()
+		fmt.Printf("socket mode connection closed: %v\n", err)
+
+		// A connection that stayed up a while resets the backoff
+		if time.Since(start) > socketMaxBackoff {
+			backoff = socketMinBackoff
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > socketMaxBackoff {
+			backoff = socketMaxBackoff
+		}
+	}
+}
+
+// runSocket handles one websocket connection until it ends
+func (l *Lorebot) runSocket() error {
+	wsURL, err := l.openSocketURL()
+	if err != nil {
+		return err
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		return err
+	}
+	conn := &socketConn{Conn: ws}
+	defer conn.Close()
+
+	for {
+		var envelope socketEnvelope
+		if err := conn.ReadJSON(&envelope); err != nil {
+			return err
+		}
+
+		switch envelope.Type {
+		case "hello":
+			fmt.Println("Socket mode connected")
+		case "disconnect":
+			return fmt.Errorf("slack asked us to reconnect: %s", envelope.Reason)
+		case "events_api":
+			// Acknowledge first; Slack redelivers anything not acked quickly
+			if err := conn.ack(envelope.EnvelopeID, nil); err != nil {
+				return err
+			}
+			var ev eventEnvelope
+			if err := json.Unmarshal(envelope.Payload, &ev); err != nil {
+				fmt.Printf("failed to decode socket event: %v\n", err)
+				continue
+			}
+			if !l.seenEvents.markSeen(ev.EventID) {
+				go l.dispatchEvent(ev.Event)
+			}
+		case "slash_commands":
+			var cmd socketSlashPayload
+			if err := json.Unmarshal(envelope.Payload, &cmd); err != nil {
+				fmt.Printf("failed to decode socket slash command: %v\n", err)
+				continue
+			}
+			go func(envelopeID string) {
+				if err := conn.ack(envelopeID, l.slashCommand(cmd.Command, cmd.Text)); err != nil {
+					fmt.Printf("failed to ack slash command: %v\n", err)
+				}
+			}(envelope.EnvelopeID)
+		case "interactive":
+			if err := conn.ack(envelope.EnvelopeID, nil); err != nil {
+				return err
+			}
+			var payload interactionPayload
+			if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+				fmt.Printf("failed to decode socket interaction: %v\n", err)
+				continue
+			}
+			go l.handleInteraction(payload)
+		default:
+			if envelope.EnvelopeID != "" {
+				if err := conn.ack(envelope.EnvelopeID, nil); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
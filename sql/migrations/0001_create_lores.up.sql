@@ -1,7 +1,8 @@
-create table lores(
+-- Existing deployments created this table by hand, so adopt it if present.
+create table if not exists lores(
   lore_id serial primary key not null,
   user_id varchar(1024) not null,
   message text not null,
   timestamp_added timestamp default current_timestamp,
   score int
-)
+);
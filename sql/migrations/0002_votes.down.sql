@@ -0,0 +1,3 @@
+drop table if exists votes;
+
+alter table lores drop column if exists added_by;
@@ -0,0 +1,9 @@
+alter table lores add column added_by varchar(1024);
+
+create table votes(
+  vote_id serial primary key not null,
+  lore_id int not null references lores(lore_id) on delete cascade,
+  user_id varchar(1024) not null,
+  timestamp_voted timestamp default current_timestamp,
+  unique (lore_id, user_id)
+);
@@ -0,0 +1 @@
+alter table lores drop column if exists hidden;
@@ -0,0 +1 @@
+alter table lores add column hidden boolean not null default false;
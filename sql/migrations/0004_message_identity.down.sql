@@ -0,0 +1,5 @@
+drop index if exists lores_channel_id_message_ts;
+
+alter table lores drop column if exists permalink;
+alter table lores drop column if exists message_ts;
+alter table lores drop column if exists channel_id;
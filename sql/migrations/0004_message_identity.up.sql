@@ -0,0 +1,7 @@
+-- Lores are identified by the Slack message they came from. Legacy rows
+-- predate this and keep null identities.
+alter table lores add column channel_id varchar(64);
+alter table lores add column message_ts varchar(64);
+alter table lores add column permalink text;
+
+create unique index lores_channel_id_message_ts on lores (channel_id, message_ts);
@@ -0,0 +1 @@
+drop table if exists lore_attachments;
@@ -0,0 +1,11 @@
+create table lore_attachments(
+  attachment_id serial primary key not null,
+  lore_id int not null references lores(lore_id) on delete cascade,
+  kind varchar(32) not null,
+  name text not null default '',
+  permalink text not null default '',
+  mimetype varchar(255) not null default '',
+  text text not null default ''
+);
+
+create index lore_attachments_lore_id on lore_attachments (lore_id);
@@ -0,0 +1 @@
+drop index if exists lores_message_fts;
@@ -0,0 +1 @@
+create index lores_message_fts on lores using gin (to_tsvector('english', message));
@@ -0,0 +1 @@
+drop index if exists votes_timestamp_voted;
@@ -0,0 +1 @@
+create index votes_timestamp_voted on votes (timestamp_voted);
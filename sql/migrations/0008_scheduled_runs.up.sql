@@ -0,0 +1,6 @@
+create table scheduled_runs(
+  job varchar(255) not null,
+  scheduled_for timestamp not null,
+  timestamp_run timestamp default current_timestamp,
+  primary key (job, scheduled_for)
+);
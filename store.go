@@ -0,0 +1,70 @@
+package main
+
+import "errors"
+import "time"
+
+// ErrAlreadyVoted is returned by UpvoteLore when the voter has already voted
+// on that lore.
+var ErrAlreadyVoted = errors.New("already voted on this lore")
+
+// ErrNoLore is returned when there's no such lore to vote on. GetLore also
+// returns it for hidden lore.
+var ErrNoLore = errors.New("no such lore")
+
+// ErrLoreExists is returned by InsertLore when the message is already lore,
+// e.g. because someone else lored it at the same moment.
+var ErrLoreExists = errors.New("message is already lore")
+
+// ErrNoVote is returned by RetractVote when there is no vote to retract.
+var ErrNoVote = errors.New("no vote to retract")
+
+// ErrNegativeOffset is returned by listings given a negative offset.
+var ErrNegativeOffset = errors.New("offset must not be negative")
+
+func checkOffset(offset int) error {
+	if offset < 0 {
+		return ErrNegativeOffset
+	}
+	return nil
+}
+
+// LoreStore is the persistence layer behind Lorebot. PostgresClient is the
+// production implementation; MemoryStore keeps everything in process so the
+// bot can be run locally and unit-tested without a database.
+type LoreStore interface {
+	// Lore is identified by the channel and timestamp of the original message
+	InsertLore(lore Lore, addedBy string) error
+	LoreExists(channelID string, messageTS string) (bool, error)
+	GetLore(channelID string, messageTS string) (Lore, error)
+	UpvoteLore(channelID string, messageTS string, voterID string) error
+	RetractVote(channelID string, messageTS string, voterID string) (int, error)
+	HideLore(channelID string, messageTS string) error
+	DeleteLore(channelID string, messageTS string) error
+	// Listings return at most limit results after skipping offset of them
+	RecentLore(limit int, offset int) ([]Lore, error)
+	RandomLore(limit int) ([]Lore, error)
+	// A zero since ranks by all time score, otherwise by votes cast since
+	TopLore(since time.Time, limit int, offset int) ([]Lore, error)
+	LoreForUser(userID string, limit int, offset int) ([]Lore, error)
+	// Lore added on day's month and day in earlier years, newest first.
+	// Lore from February 29th comes up on the 28th in other years.
+	LoreOnThisDay(day time.Time, limit int, offset int) ([]Lore, error)
+	SearchLore(query string, limit int, offset int) ([]Lore, error)
+	SearchLoreFiltered(filter SearchFilter, limit int, offset int) ([]Lore, error)
+	Highscores(since time.Time, limit int, offset int) ([]Highscore, error)
+	// ClaimScheduledRun records that job is running for the time it was
+	// scheduled at. It reports false if that run was already claimed, so a
+	// restarted bot doesn't post it twice.
+	ClaimScheduledRun(job string, scheduledFor time.Time) (bool, error)
+}
+
+// anniversaryDays returns the days of day's month whose lore has its
+// anniversary on day. That's just day itself, except that February 29th's
+// lore would otherwise only come up in leap years.
+func anniversaryDays(day time.Time) []int {
+	leapYear := time.Date(day.Year(), time.February, 29, 0, 0, 0, 0, time.UTC).Day() == 29
+	if day.Month() == time.February && day.Day() == 28 && !leapYear {
+		return []int{28, 29}
+	}
+	return []int{day.Day()}
+}
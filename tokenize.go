@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Slack sends message text in its mrkdwn encoding: mentions, channels and
+// links arrive as <@U123|name>, <#C123|name> and <https://...|label>, and
+// &, < and > in what people typed arrive as &amp;, &lt; and &gt;.
+// See: https://api.slack.com/reference/surfaces/formatting#escaping
+
+// token is one whitespace separated (or quoted) piece of a command
+type token struct {
+	Text   string // decoded, with any Slack markup left intact
+	Quoted bool
+	UserID string // set when the token is exactly a user mention
+}
+
+var slackEntities = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+
+func isQuote(r rune) bool {
+	return r == '"' || r == '“' || r == '”'
+}
+
+// tokenize splits message text into tokens. Any amount of whitespace
+// separates tokens, "quoted phrases" are a single token, and Slack markup is
+// never split even if its label has spaces in it.
+func tokenize(text string) []token {
+	tokens := make([]token, 0)
+	runes := []rune(text)
+
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		if isQuote(runes[i]) {
+			end := i + 1
+			for end < len(runes) && !isQuote(runes[end]) {
+				end++
+			}
+			// An unterminated quote runs to the end of the text
+			tokens = append(tokens, token{Text: slackEntities.Replace(string(runes[i+1 : end])), Quoted: true})
+			i = end + 1
+			continue
+		}
+
+		var sb strings.Builder
+		plain := 0 // start of the run of plain text waiting to be decoded
+		start := i
+		for i < len(runes) && !unicode.IsSpace(runes[i]) {
+			if runes[i] != '<' {
+				i++
+				continue
+			}
+			end := i + 1
+			for end < len(runes) && runes[end] != '>' {
+				end++
+			}
+			if end == len(runes) {
+				// Not markup after all, Slack would have escaped a literal <
+				i++
+				continue
+			}
+			sb.WriteString(slackEntities.Replace(string(runes[start+plain : i])))
+			sb.WriteString(string(runes[i : end+1]))
+			i = end + 1
+			plain = i - start
+		}
+		sb.WriteString(slackEntities.Replace(string(runes[start+plain : i])))
+
+		tok := token{Text: sb.String()}
+		if strings.HasPrefix(tok.Text, "<@") && strings.HasSuffix(tok.Text, ">") {
+			tok.UserID = parseUserID(tok.Text)
+		}
+		tokens = append(tokens, tok)
+	}
+	return tokens
+}
+
+// tokenTexts returns the text of each token
+func tokenTexts(tokens []token) []string {
+	ret := make([]string, len(tokens))
+	for i, tok := range tokens {
+		ret[i] = tok.Text
+	}
+	return ret
+}
+
+// commandTokens finds the command addressed to botID in a message: whatever
+// follows a leading mention, or a single word before a trailing one, as in
+// "top @lorebot". Reports false if the message isn't addressed to botID that
+// way, e.g. if it's mentioned mid sentence.
+func commandTokens(tokens []token, botID string) ([]token, bool) {
+	if botID == "" || len(tokens) < 2 {
+		return nil, false
+	}
+	if tokens[0].UserID == botID {
+		return tokens[1:], true
+	}
+	if len(tokens) == 2 && tokens[1].UserID == botID {
+		return tokens[:1], true
+	}
+	return nil, false
+}
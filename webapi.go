@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// The vendored slack client predates some of the Web API methods we need,
+// so those are called directly.
+
+var slackAPIURL = "https://slack.com/api/"
+
+var webAPIClient = &http.Client{Timeout: 10 * time.Second}
+
+type webAPIResponse struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+// callWebAPI POSTs a form encoded request to a Slack Web API method and
+// decodes the JSON response into out, which may be nil.
+func callWebAPI(token string, method string, values url.Values, out interface{}) error {
+	req, err := http.NewRequest("POST", slackAPIURL+method, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := webAPIClient.Do(req)
+	if err != nil {
+		slackAPIErrors.Inc(method)
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		slackAPIErrors.Inc(method)
+		return fmt.Errorf("%s: failed to decode response: %v", method, err)
+	}
+	var status webAPIResponse
+	if err := json.Unmarshal(body, &status); err != nil {
+		slackAPIErrors.Inc(method)
+		return err
+	}
+	if !status.Ok {
+		slackAPIErrors.Inc(method)
+		return fmt.Errorf("%s: %s", method, status.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// webMessage is a message as the Web API returns it. The vendored
+// slack.Message predates the files array that uploads now come in.
+type webMessage struct {
+	slack.Message
+	Files []slack.File `json:"files"`
+}
+
+// conversationMessages calls conversations.history or conversations.replies
+func (l *Lorebot) conversationMessages(method string, values url.Values) ([]webMessage, error) {
+	var resp struct {
+		Messages []webMessage `json:"messages"`
+	}
+	if err := callWebAPI(l.Token, method, values, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
+
+// GetPermalink returns a link to the message at timestamp in channelID.
+// See: https://api.slack.com/methods/chat.getPermalink
+func (l *Lorebot) GetPermalink(channelID string, timestamp string) (string, error) {
+	var resp struct {
+		Permalink string `json:"permalink"`
+	}
+	values := url.Values{"channel": {channelID}, "message_ts": {timestamp}}
+	if err := callWebAPI(l.Token, "chat.getPermalink", values, &resp); err != nil {
+		return "", err
+	}
+	return resp.Permalink, nil
+}